@@ -0,0 +1,185 @@
+// Package catalog writes metadata of all crawled items to JSON Lines and CSV files without downloading the items
+package catalog
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/xarantolus/ccan-archiver/zipfactory"
+)
+
+// FormatBasename returns the file name without extension the catalog files are created with
+func FormatBasename() string {
+	return time.Now().Format("CCAN-Clonk-Center-Katalog-2006-01-02")
+}
+
+// CreateCatalogFiles writes all items from input to `basename.jsonl` and `basename.csv`.
+// If ctx is done, the files are written with all items that were received until then and ctx.Err() is returned
+func CreateCatalogFiles(ctx context.Context, input <-chan zipfactory.Archivable, basename string) (count int, err error) {
+	jf, err := os.Create(basename + ".jsonl")
+	if err != nil {
+		return
+	}
+	defer jf.Close()
+
+	cf, err := os.Create(basename + ".csv")
+	if err != nil {
+		return
+	}
+	defer cf.Close()
+
+	count, err = Write(ctx, input, jf, cf)
+	if err != nil {
+		return
+	}
+
+	if err = jf.Close(); err != nil {
+		return
+	}
+	if err = cf.Close(); err != nil {
+		return
+	}
+	return count, ctx.Err()
+}
+
+// Write writes every item from input as one JSON object per line to jsonl, and as a row to csv.
+// The CSV columns are the source name and all json fields of all items, so they are only known after the last item.
+// That's why CSV output is written after input has been closed or ctx is done
+func Write(ctx context.Context, input <-chan zipfactory.Archivable, jsonl, csvw io.Writer) (count int, err error) {
+	var (
+		columns     = []string{"source"}
+		knownColumn = map[string]bool{"source": true}
+		rows        []map[string]string
+	)
+
+loop:
+	for {
+		var item zipfactory.Archivable
+		select {
+		case <-ctx.Done():
+			break loop
+		case i, ok := <-input:
+			if !ok {
+				break loop
+			}
+			item = i
+		}
+
+		fields, err := flatten(item)
+		if err != nil {
+			return count, fmt.Errorf("while converting %s: %s", item.GetDownloadLink(), err.Error())
+		}
+
+		line, err := fields.MarshalJSON()
+		if err != nil {
+			return count, err
+		}
+		if _, err = jsonl.Write(append(line, '\n')); err != nil {
+			return count, err
+		}
+
+		var row = make(map[string]string, len(fields))
+		for _, f := range fields {
+			if !knownColumn[f.key] {
+				knownColumn[f.key] = true
+				columns = append(columns, f.key)
+			}
+			row[f.key] = csvValue(f.value)
+		}
+		rows = append(rows, row)
+		count++
+	}
+
+	w := csv.NewWriter(csvw)
+	if err = w.Write(columns); err != nil {
+		return
+	}
+	for _, row := range rows {
+		var record = make([]string, len(columns))
+		for i, c := range columns {
+			record[i] = row[c]
+		}
+		if err = w.Write(record); err != nil {
+			return
+		}
+	}
+	w.Flush()
+
+	return count, w.Error()
+}
+
+type field struct {
+	key   string
+	value json.RawMessage
+}
+
+// fieldList is a json object that keeps the order of its keys
+type fieldList []field
+
+func (f fieldList) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, field := range f {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		key, err := json.Marshal(field.key)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(key)
+		buf.WriteByte(':')
+		buf.Write(field.value)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// flatten returns the source name and all json fields of item in the order they are defined in
+func flatten(item zipfactory.Archivable) (fields fieldList, err error) {
+	source, err := json.Marshal(item.GetSourceName())
+	if err != nil {
+		return
+	}
+	fields = append(fields, field{"source", source})
+
+	content, err := json.Marshal(item)
+	if err != nil {
+		return
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(content))
+	if t, err := dec.Token(); err != nil || t != json.Delim('{') {
+		return nil, fmt.Errorf("item is not a json object")
+	}
+	for dec.More() {
+		t, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		var value json.RawMessage
+		if err = dec.Decode(&value); err != nil {
+			return nil, err
+		}
+		fields = append(fields, field{t.(string), value})
+	}
+	return
+}
+
+// csvValue converts a json value to the text in a csv cell. Strings are unquoted, everything else stays json
+func csvValue(value json.RawMessage) string {
+	var s string
+	if err := json.Unmarshal(value, &s); err == nil {
+		return s
+	}
+	if string(value) == "null" {
+		return ""
+	}
+	return string(value)
+}
@@ -0,0 +1,44 @@
+package catalog
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/xarantolus/ccan-archiver/crawler"
+	"github.com/xarantolus/ccan-archiver/zipfactory"
+)
+
+func TestWrite(t *testing.T) {
+	var input = make(chan zipfactory.Archivable, 2)
+	input <- crawler.CCANItem{Name: "Western", Author: "Sven2", Votes: 12, Date: time.Date(2009, 12, 24, 18, 30, 0, 0, time.UTC)}
+	input <- crawler.CCItem{Name: "Hazard, \"the\" Pack", Author: "Matthi", PostedBy: "Admin"}
+	close(input)
+
+	var jsonl, csv bytes.Buffer
+	count, err := Write(context.Background(), input, &jsonl, &csv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 2 {
+		t.Errorf("wrote %d items, expected 2", count)
+	}
+
+	lines := strings.Split(strings.TrimSpace(jsonl.String()), "\n")
+	if len(lines) != 2 || !strings.HasPrefix(lines[0], `{"source":"CCAN","type":"","name":"Western"`) {
+		t.Errorf("unexpected JSON Lines output:\n%s", jsonl.String())
+	}
+
+	rows := strings.Split(strings.TrimSpace(csv.String()), "\n")
+	if len(rows) != 3 {
+		t.Fatalf("expected header and two rows, got:\n%s", csv.String())
+	}
+	if !strings.HasPrefix(rows[0], "source,type,name,date,") || !strings.HasSuffix(rows[0], ",posted_by,description,rating") {
+		t.Errorf("unexpected header %q", rows[0])
+	}
+	if !strings.Contains(rows[1], ",Western,2009-12-24T18:30:00Z,") || !strings.HasPrefix(rows[2], `Clonk-Center,,"Hazard, ""the"" Pack",`) {
+		t.Errorf("unexpected rows:\n%s", csv.String())
+	}
+}
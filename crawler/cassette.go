@@ -0,0 +1,133 @@
+package crawler
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+// CassetteMode decides whether a Cassette records or replays responses
+type CassetteMode int
+
+const (
+	// Record sends requests using the underlying transport and stores the responses
+	Record CassetteMode = iota
+	// Replay serves stored responses without using the network
+	Replay
+)
+
+// Cassette is an http.RoundTripper that records request/response pairs in a directory or replays them from there.
+// This makes it possible to develop and test crawlers without accessing the real sites
+type Cassette struct {
+	Dir  string
+	Mode CassetteMode
+
+	// Transport is used for recording. If it is nil, http.DefaultTransport is used
+	Transport http.RoundTripper
+}
+
+// cassetteEntry is the metadata of a recorded response, the body is stored in a separate file
+type cassetteEntry struct {
+	Method     string      `json:"method"`
+	URL        string      `json:"url"`
+	StatusCode int         `json:"status_code"`
+	Header     http.Header `json:"header"`
+}
+
+// RoundTrip implements http.RoundTripper
+func (c *Cassette) RoundTrip(req *http.Request) (*http.Response, error) {
+	if c.Mode == Replay {
+		return c.replay(req)
+	}
+	return c.record(req)
+}
+
+// paths returns the metadata and body file names for a request
+func (c *Cassette) paths(req *http.Request) (meta, body string) {
+	sum := sha256.Sum256([]byte(req.Method + " " + req.URL.String()))
+	name := filepath.Join(c.Dir, hex.EncodeToString(sum[:10]))
+	return name + ".json", name + ".body"
+}
+
+func (c *Cassette) record(req *http.Request) (*http.Response, error) {
+	transport := c.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+
+	content, err := ioutil.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(content))
+
+	entry, err := json.MarshalIndent(cassetteEntry{
+		Method:     req.Method,
+		URL:        req.URL.String(),
+		StatusCode: resp.StatusCode,
+		Header:     resp.Header,
+	}, "", "    ")
+	if err != nil {
+		return nil, err
+	}
+
+	if err = os.MkdirAll(c.Dir, 0755); err != nil {
+		return nil, err
+	}
+	metaPath, bodyPath := c.paths(req)
+	if err = ioutil.WriteFile(bodyPath, content, 0644); err != nil {
+		return nil, err
+	}
+	// The metadata is written last, so an entry is only replayed if its body exists
+	if err = ioutil.WriteFile(metaPath, entry, 0644); err != nil {
+		return nil, err
+	}
+
+	return resp, nil
+}
+
+func (c *Cassette) replay(req *http.Request) (*http.Response, error) {
+	metaPath, bodyPath := c.paths(req)
+
+	meta, err := ioutil.ReadFile(metaPath)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("cassette %s has no recording for %s %s", c.Dir, req.Method, req.URL.String())
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var entry cassetteEntry
+	if err = json.Unmarshal(meta, &entry); err != nil {
+		return nil, fmt.Errorf("invalid recording %s: %s", metaPath, err.Error())
+	}
+
+	content, err := ioutil.ReadFile(bodyPath)
+	if err != nil {
+		return nil, err
+	}
+
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", entry.StatusCode, http.StatusText(entry.StatusCode)),
+		StatusCode:    entry.StatusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        entry.Header,
+		Body:          ioutil.NopCloser(bytes.NewReader(content)),
+		ContentLength: int64(len(content)),
+		Request:       req,
+	}, nil
+}
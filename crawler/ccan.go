@@ -2,29 +2,29 @@ package crawler
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"io"
 	"log"
-	"net/http"
 	"regexp"
-	"strconv"
-	"strings"
 	"time"
 
+	"github.com/PuerkitoBio/goquery"
 	"github.com/xarantolus/ccan-archiver/zipfactory"
 	"golang.org/x/net/html"
 )
 
 const (
-	// url is the url to the listing that is embedded on http://ccan.de
-	url string = "https://ccan.de/cgi-bin/ccan/ccan-view.pl?a=&sc=tm&so=d&nr=250&ac=ty-ti-ni-tm-ca-dc-ev-vo-si&reveal=1&pg=%d"
+	// listingURL is the url to the listing that is embedded on http://ccan.de
+	listingURL string = "https://ccan.de/cgi-bin/ccan/ccan-view.pl?a=&sc=tm&so=d&nr=250&ac=ty-ti-ni-tm-ca-dc-ev-vo-si&reveal=1&pg=%d"
 
 	// dateFormat is the date format used in the listing
 	ccanDateFormat string = "02.01.06 15:04"
 )
 
-// CCANItem is an item from the listing at `url`
+// CCANItem is an item from the listing at `listingURL`
 type CCANItem struct {
+	Type          string    `json:"type"`
 	Name          string    `json:"name"`
 	Date          time.Time `json:"date"`
 	DownloadCount int       `json:"download_count"`
@@ -33,6 +33,10 @@ type CCANItem struct {
 	Category      string    `json:"category"`
 	Engine        string    `json:"engine"`
 	DownloadLink  string    `json:"download_link"`
+	Size          int64     `json:"size"` // in bytes, 0 if unknown
+
+	// SHA256 is the expected hex checksum of the file. It is only known for manifest items that specify it
+	SHA256 string `json:"sha256,omitempty"`
 }
 
 // Implement zipfactory.Archivable
@@ -53,176 +57,140 @@ func (c CCANItem) GetSourceName() string {
 	return "CCAN"
 }
 
-// CrawlCCAN crawls the entire listing and returns items in the channel - it will not be closed
-func CrawlCCAN(output chan zipfactory.Archivable) (errorlist []error) {
-	var totalItemsLoaded int
-	var pageCounter int
+// GetSHA256 implements zipfactory.Verifiable
+func (c CCANItem) GetSHA256() string {
+	return c.SHA256
+}
 
-	// Add items that aren't listed on ccan.de, but might be needed - See items.go (they are part of this crawler as the files will be in the right directory to find them easily)
-	for _, nonlistedItem := range additionalItems {
-		output <- nonlistedItem
-	}
+// GetDate implements zipfactory.Dated
+func (c CCANItem) GetDate() time.Time {
+	return c.Date
+}
 
-	var errorCount = 0
-	for {
-		var currentPageItemCount int
+const ccanSourceName = "ccan"
 
-		fmt.Printf("Fetching %d. page\n", pageCounter+1)
-		var pageContent, err = DoRequest(fmt.Sprintf(url, pageCounter))
-		if err != nil {
-			errorCount++
-			errorlist = append(errorlist, fmt.Errorf("Error while downloading listing page %d (try %d/6): %s", pageCounter, errorCount+1, err.Error()))
+// ccanSource is the Source for ccan.de
+type ccanSource struct {
+	opts Options
+}
 
-			if errorCount > 5 {
-				log.Fatalln(err)
-			}
+func (*ccanSource) Name() string {
+	return ccanSourceName
+}
 
-			log.Println(err)
+func (*ccanSource) Description() string {
+	return "ccan.de"
+}
+
+func (c *ccanSource) Configure(opts Options) {
+	c.opts = opts
+}
 
-			time.Sleep(5 * time.Second)
-			continue
+func (c *ccanSource) Crawl(ctx context.Context, output chan<- zipfactory.Archivable) error {
+	return ErrorList(CrawlCCAN(ctx, output, c.opts)).Err()
+}
+
+// CrawlCCAN crawls the entire listing and returns items in the channel - it will not be closed.
+// Up to opts.Workers pages are loaded at the same time, but items are always sent in the order of the listing.
+// Listing pages that fail to load are handled according to opts.ErrorPolicy. It stops early if ctx is done or it reached opts.CCANStopBefore
+func CrawlCCAN(ctx context.Context, output chan<- zipfactory.Archivable, opts Options) (errorlist []error) {
+	// Add items that aren't listed on ccan.de, but might be needed - See items.go (they are part of this crawler as the files will be in the right directory to find them easily)
+	for _, nonlistedItem := range opts.AdditionalItems {
+		if err := sendItem(ctx, output, nonlistedItem); err != nil {
+			return append(errorlist, err)
 		}
+	}
+
+	// Pages are loaded in parallel, but handled in order. If a page is empty, we reached the end of the listing
+	var streak = failureStreak{policy: opts.ErrorPolicy}
+	runOrdered(ctx, opts.Workers, 0, func(ctx context.Context, page int) interface{} {
+		return loadListingPage(ctx, opts.Fetcher, opts.ErrorPolicy, page)
+	}, func(page int, result interface{}) bool {
+		res := result.(listingPageResult)
+		if res.err != nil {
+			pageErr, ok := res.err.(*PageError)
+			if !ok {
+				return false // ctx is done
+			}
 
-		node, err := html.Parse(pageContent)
-		// Close content after parsing, but ignore errors
-		_ = pageContent.Close()
+			streak.failed(pageErr)
+			errorlist = append(errorlist, pageErr)
+			return !pageErr.Aborted
+		}
+		streak.loaded()
 
+		items, skipped, rowCount, err := parseListingPage(res.doc, page)
 		if err != nil {
-			errorCount++
-			errorlist = append(errorlist, fmt.Errorf("Failed to parse html, attempt %d: %s", errorCount, err.Error()))
+			errorlist = append(errorlist, &LayoutError{Page: page, Err: err})
+			return false
+		}
+		for _, row := range skipped {
+			errorlist = append(errorlist, row)
+		}
 
-			if errorCount > 5 {
-				log.Fatalln(err)
+		var links = make([]string, len(items))
+		for i, item := range items {
+			if err := sendItem(ctx, output, item); err != nil {
+				return false
 			}
+			links[i] = item.DownloadLink
+		}
 
-			log.Println(err)
-
-			time.Sleep(5 * time.Second)
-			continue
+		// The listing is sorted by date, so pages shift when new items are uploaded. That's why they are always crawled again,
+		// the journal only records them
+		if opts.Journal != nil && len(links) > 0 {
+			opts.Journal.PageCrawled(ccanSourceName, page, links)
 		}
-		errorCount = 0
-
-		// First should be ignored
-		var tbodyFirst = node.LastChild.LastChild.FirstChild.NextSibling.FirstChild.FirstChild.FirstChild.NextSibling
-
-		for tbodyFirst.NextSibling != nil {
-			// print(renderNode(tbodyFirst) + "\n\n")
-
-			currentResult := CCANItem{}
-
-			currentNode := tbodyFirst.FirstChild
-
-			var counter int
-			var resValid = true
-			for currentNode.NextSibling != nil {
-
-				switch counter {
-				case 1:
-					{
-						var nameNode = currentNode.FirstChild.FirstChild
-
-						currentResult.Name = strings.Trim(renderWithoutTags(nameNode), " ")
-						// println("Name:", currentResult.Name)
-					}
-				case 2:
-					{
-						if currentNode == nil || currentNode.FirstChild == nil {
-							resValid = false
-							break // because we don't get a download link
-						}
-
-						currLink := ""
-
-						for _, a := range currentNode.FirstChild.Attr {
-							if a.Key == "href" {
-								currLink = "https://ccan.de/cgi-bin/ccan/" + a.Val
-								break
-							}
-						}
-
-						if currLink == "" || currLink == "https://ccan.de/cgi-bin/ccan/" {
-							resValid = false
-							break
-						}
-						currentResult.DownloadLink = currLink
-						// println("Link:", currentResult.DownloadLink)
-					}
-				case 3:
-					{
-						currentResult.Category = strings.Trim(renderWithoutTags(currentNode.FirstChild.FirstChild), " ")
-						// println("Category:", currentResult.Category)
-					}
-				case 4:
-					{
-						currentResult.Author = strings.Trim(renderWithoutTags(currentNode.FirstChild.FirstChild), " ")
-						// println("Author:", currentResult.Author)
-					}
-				case 5:
-					{
-						if currentNode == nil || currentNode.FirstChild == nil || currentNode.FirstChild.FirstChild == nil {
-							resValid = false
-							break // because we don't get a engine
-						}
-						currentResult.Engine = strings.Trim(renderWithoutTags(currentNode.FirstChild.FirstChild), " ")
-						// println("Engine:", currentResult.Engine)
-					}
-				case 6:
-					{
-						votescount, err := strconv.ParseInt(strings.Trim(renderWithoutTags(currentNode.FirstChild), " "), 10, 64)
-						if err != nil {
-							resValid = false
-							break
-						}
-						currentResult.Votes = int(votescount)
-						// println("Votes:", currentResult.Votes)
-					}
-				case 7:
-					{
-						dlCount, err := strconv.ParseInt(strings.Trim(renderWithoutTags(currentNode.FirstChild), " "), 10, 64)
-						if err != nil {
-							resValid = false
-							break
-						}
-						currentResult.DownloadCount = int(dlCount)
-						// println("Downloads:", currentResult.DownloadCount)
-					}
-				case 9:
-					{
-						date, err := parseCCANDate(strings.Trim(renderNode(currentNode.FirstChild), " "))
-						if err != nil {
-							resValid = false
-							break
-						}
-						currentResult.Date = date
-						// println("Date:", date.Format("Jan 2, 2006 um 15:04"))
-					}
-				}
 
-				if !resValid {
-					break
+		// Exit if we reached items that are older than needed
+		if !opts.CCANStopBefore.IsZero() {
+			for _, item := range items {
+				if item.Date.Before(opts.CCANStopBefore) {
+					return false
 				}
-
-				currentNode = currentNode.NextSibling
-				counter++
 			}
+		}
 
-			if resValid && currentResult.Author != "" && currentResult.Name != "" && currentResult.Category != "" && currentResult.DownloadLink != "" && currentResult.Engine != "" {
-				output <- currentResult
-				totalItemsLoaded++
-				currentPageItemCount++
-			}
+		// Exit if the page we just loaded was empty
+		return rowCount != 0
+	})
+
+	if ctx.Err() != nil {
+		errorlist = append(errorlist, ctx.Err())
+	}
+	return
+}
+
+// listingPageResult is the result of loadListingPage
+type listingPageResult struct {
+	doc *goquery.Document
+	err error // *PageError if the page could not be loaded, or the error of ctx
+}
 
-			tbodyFirst = tbodyFirst.NextSibling
+// loadListingPage loads the listing page with the given number, retrying it according to policy
+func loadListingPage(ctx context.Context, f *Fetcher, policy ErrorPolicy, page int) listingPageResult {
+	var retrier = pageRetrier{policy: policy}
+	for {
+		fmt.Printf("Fetching %d. page\n", page+1)
+		doc, err := fetchListingPage(ctx, f, page)
+		if err == nil {
+			return listingPageResult{doc: doc}
+		}
+		if ctx.Err() != nil {
+			return listingPageResult{err: ctx.Err()}
 		}
 
-		// Exit if the page we just loaded was empty
-		if currentPageItemCount == 0 {
-			break
+		log.Printf("Error while loading listing page %d: %s\n", page, err.Error())
+
+		retryAfter, pageErr := retrier.failure(page, err)
+		if pageErr != nil {
+			return listingPageResult{err: pageErr}
 		}
 
-		pageCounter++
+		if err := sleep(ctx, retryAfter); err != nil {
+			return listingPageResult{err: err}
+		}
 	}
-	return
 }
 
 // renderNode renders the text of a html node and ignores errors
@@ -250,26 +218,19 @@ func parseCCANDate(input string) (output time.Time, err error) {
 	return
 }
 
-// DoRequest opens the file at the specified url
-func DoRequest(url string) (io.ReadCloser, error) {
-	client := http.Client{
-		Timeout: time.Hour,
-	}
-
-	req, err := http.NewRequest(http.MethodGet, url, nil)
+// fetchListingPage downloads and parses the listing page with the given number
+func fetchListingPage(ctx context.Context, f *Fetcher, page int) (*goquery.Document, error) {
+	pageContent, err := f.Open(ctx, fmt.Sprintf(listingURL, page))
 	if err != nil {
 		return nil, err
 	}
+	// Close content after parsing, but ignore errors
+	defer pageContent.Close()
 
-	// Do request
-	res, err := client.Do(req)
-	if err != nil {
-		return nil, err
-	}
-
-	if res.StatusCode < 200 || res.StatusCode > 399 {
-		return nil, fmt.Errorf("Error in http request: StatusCode is %d", res.StatusCode)
-	}
+	return goquery.NewDocumentFromReader(pageContent)
+}
 
-	return res.Body, nil
+// DoRequest opens the file at the specified url using the DefaultFetcher. The request is aborted if ctx is done
+func DoRequest(ctx context.Context, url string) (io.ReadCloser, error) {
+	return DefaultFetcher.Open(ctx, url)
 }
@@ -0,0 +1,285 @@
+package crawler
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/PuerkitoBio/goquery"
+)
+
+// ccanBaseURL is the url relative links in the listing are resolved against
+const ccanBaseURL = "https://ccan.de/cgi-bin/ccan/"
+
+// ccanColumn is a column of the ccan.de listing
+type ccanColumn int
+
+const (
+	ccanColumnType ccanColumn = iota
+	ccanColumnName
+	ccanColumnDownload
+	ccanColumnCategory
+	ccanColumnAuthor
+	ccanColumnEngine
+	ccanColumnVotes
+	ccanColumnDownloadCount
+	ccanColumnSize
+	ccanColumnDate
+)
+
+// ccanColumnLabels contains the header labels (normalized using normalizeLabel) that identify a column
+var ccanColumnLabels = map[ccanColumn][]string{
+	ccanColumnType:          {"typ", "type"},
+	ccanColumnName:          {"titel", "title", "name"},
+	ccanColumnDownload:      {"download"},
+	ccanColumnCategory:      {"kategorie", "category"},
+	ccanColumnAuthor:        {"autor", "author", "nick"},
+	ccanColumnEngine:        {"engine"},
+	ccanColumnVotes:         {"stimmen", "votes"},
+	ccanColumnDownloadCount: {"downloads"},
+	ccanColumnSize:          {"größe", "size"},
+	ccanColumnDate:          {"datum", "date"},
+}
+
+// ccanColumnPositions is the order of the columns requested by listingURL. A column whose header has no known label,
+// e.g. because it is empty, is assumed to be at this position
+var ccanColumnPositions = map[ccanColumn]int{
+	ccanColumnType:          0,
+	ccanColumnName:          1,
+	ccanColumnDownload:      2,
+	ccanColumnCategory:      3,
+	ccanColumnAuthor:        4,
+	ccanColumnEngine:        5,
+	ccanColumnVotes:         6,
+	ccanColumnDownloadCount: 7,
+	ccanColumnSize:          8,
+	ccanColumnDate:          9,
+}
+
+// requiredCCANColumns must be present in the listing, else the layout of the site has changed
+var requiredCCANColumns = []ccanColumn{
+	ccanColumnName, ccanColumnDownload, ccanColumnCategory, ccanColumnAuthor,
+	ccanColumnEngine, ccanColumnVotes, ccanColumnDownloadCount, ccanColumnDate,
+}
+
+func (c ccanColumn) String() string {
+	return ccanColumnLabels[c][0]
+}
+
+// LayoutError is returned if a listing page doesn't have the expected structure.
+// This usually means that the site was changed and the crawler must be updated
+type LayoutError struct {
+	Page int
+	Err  error
+}
+
+func (l *LayoutError) Error() string {
+	return fmt.Sprintf("Layout changed on listing page %d: %s - crawl aborted", l.Page, l.Err.Error())
+}
+
+func (l *LayoutError) Unwrap() error {
+	return l.Err
+}
+
+func (l *LayoutError) Is(target error) bool {
+	return target == ErrAborted
+}
+
+// normalizeLabel makes header labels comparable by removing sort arrows, colons etc.
+func normalizeLabel(label string) string {
+	return strings.ToLower(strings.TrimFunc(label, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}))
+}
+
+// findListingTable finds the table that contains the listing and maps columns to their index. Columns are found by
+// their label; those that don't have one fall back to their position in ccanColumnPositions, as long as that header
+// cell isn't labeled as another column. If there is no such table, the error names the first column that is missing
+func findListingTable(doc *goquery.Document) (table *goquery.Selection, columns map[ccanColumn]int, err error) {
+	var labelColumns = make(map[string]ccanColumn)
+	for column, labels := range ccanColumnLabels {
+		for _, label := range labels {
+			labelColumns[label] = column
+		}
+	}
+
+	var bestMissing []ccanColumn
+	doc.Find("table").EachWithBreak(func(_ int, t *goquery.Selection) bool {
+		var (
+			found   = make(map[ccanColumn]int)
+			labeled = make(map[int]bool)
+			header  = t.Find("tr").First().Children()
+		)
+		header.Each(func(i int, cell *goquery.Selection) {
+			column, ok := labelColumns[normalizeLabel(cell.Text())]
+			if !ok {
+				return
+			}
+			labeled[i] = true
+			if _, duplicate := found[column]; !duplicate {
+				found[column] = i
+			}
+		})
+
+		// Tables without any known label are not the listing, e.g. those used for the layout of the page
+		if len(labeled) > 0 {
+			for column, position := range ccanColumnPositions {
+				if _, ok := found[column]; !ok && position < header.Length() && !labeled[position] {
+					found[column] = position
+				}
+			}
+		}
+
+		var missing []ccanColumn
+		for _, column := range requiredCCANColumns {
+			if _, ok := found[column]; !ok {
+				missing = append(missing, column)
+			}
+		}
+		if len(missing) == 0 {
+			table, columns = t, found
+			return false
+		}
+		if bestMissing == nil || len(missing) < len(bestMissing) {
+			bestMissing = missing
+		}
+		return true
+	})
+
+	if table != nil {
+		return
+	}
+	if bestMissing == nil {
+		return nil, nil, fmt.Errorf("expected a table containing the listing")
+	}
+	return nil, nil, fmt.Errorf("expected column %q", bestMissing[0].String())
+}
+
+// SkippedRow is a listing row that was dropped because it didn't pass validation
+type SkippedRow struct {
+	Page int    `json:"page"`
+	Rule string `json:"rule"` // the rule that failed, e.g. "missing download link"
+	HTML string `json:"html"`
+}
+
+func (s *SkippedRow) Error() string {
+	return fmt.Sprintf("Skipped row on listing page %d: %s", s.Page, s.Rule)
+}
+
+// parseListingPage returns all valid items on a listing page and all rows that were skipped.
+// rowCount is the number of rows in the listing, including skipped ones
+func parseListingPage(doc *goquery.Document, page int) (items []CCANItem, skipped []*SkippedRow, rowCount int, err error) {
+	table, columns, err := findListingTable(doc)
+	if err != nil {
+		return
+	}
+
+	// The first row is the header
+	table.Find("tr").Slice(1, goquery.ToEnd).Each(func(_ int, row *goquery.Selection) {
+		rowCount++
+
+		item, rule := parseListingRow(row.Children(), columns)
+		if rule == "" {
+			items = append(items, item)
+			return
+		}
+
+		rowHTML, _ := goquery.OuterHtml(row)
+		skipped = append(skipped, &SkippedRow{
+			Page: page,
+			Rule: rule,
+			HTML: rowHTML,
+		})
+	})
+
+	return
+}
+
+// parseListingRow parses the cells of a row. If the row is invalid, the failed rule is returned
+func parseListingRow(cells *goquery.Selection, columns map[ccanColumn]int) (item CCANItem, failedRule string) {
+	cellText := func(column ccanColumn) string {
+		return strings.TrimSpace(cells.Eq(columns[column]).Text())
+	}
+
+	for _, column := range requiredCCANColumns {
+		if columns[column] >= cells.Length() {
+			return item, fmt.Sprintf("missing column %q", column.String())
+		}
+	}
+
+	item.Name = cellText(ccanColumnName)
+	item.Category = cellText(ccanColumnCategory)
+	item.Author = cellText(ccanColumnAuthor)
+	item.Engine = cellText(ccanColumnEngine)
+
+	href, exists := cells.Eq(columns[ccanColumnDownload]).Find("a[href]").Attr("href")
+	if !exists || strings.TrimSpace(href) == "" {
+		return item, "missing download link"
+	}
+	link, err := resolveCCANLink(href)
+	if err != nil {
+		return item, "invalid download link: " + err.Error()
+	}
+	item.DownloadLink = link
+
+	if item.Votes, err = strconv.Atoi(cellText(ccanColumnVotes)); err != nil {
+		return item, "unparsable votes: " + err.Error()
+	}
+	if item.DownloadCount, err = strconv.Atoi(cellText(ccanColumnDownloadCount)); err != nil {
+		return item, "unparsable download count: " + err.Error()
+	}
+	if item.Date, err = parseCCANDate(cellText(ccanColumnDate)); err != nil {
+		return item, "bad date: " + err.Error()
+	}
+
+	// Type and size are not required, they are just nice to have. A size that is given must be valid though
+	if index, exists := columns[ccanColumnType]; exists && index < cells.Length() {
+		item.Type = cellLabel(cells.Eq(index))
+	}
+	if index, exists := columns[ccanColumnSize]; exists && index < cells.Length() {
+		if size := strings.TrimSpace(cells.Eq(index).Text()); size != "" {
+			if item.Size, err = parseFileSize(size); err != nil {
+				return item, "unparsable size: " + err.Error()
+			}
+		}
+	}
+
+	switch {
+	case item.Name == "":
+		return item, "missing name"
+	case item.Author == "":
+		return item, "missing author"
+	case item.Category == "":
+		return item, "missing category"
+	case item.Engine == "":
+		return item, "missing engine"
+	}
+	return item, ""
+}
+
+// cellLabel returns the text of a cell. Some cells only contain an icon, in that case its alt or title text is used
+func cellLabel(cell *goquery.Selection) string {
+	if text := strings.TrimSpace(cell.Text()); text != "" {
+		return text
+	}
+	img := cell.Find("img").First()
+	if alt := strings.TrimSpace(img.AttrOr("alt", "")); alt != "" {
+		return alt
+	}
+	return strings.TrimSpace(img.AttrOr("title", ""))
+}
+
+// resolveCCANLink resolves a link from the listing to an absolute url
+func resolveCCANLink(href string) (string, error) {
+	base, err := url.Parse(ccanBaseURL)
+	if err != nil {
+		return "", err
+	}
+	ref, err := url.Parse(strings.TrimSpace(href))
+	if err != nil {
+		return "", err
+	}
+	return base.ResolveReference(ref).String(), nil
+}
@@ -0,0 +1,98 @@
+package crawler
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/PuerkitoBio/goquery"
+)
+
+func loadDocument(t *testing.T, path string) *goquery.Document {
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	doc, err := goquery.NewDocumentFromReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return doc
+}
+
+func TestParseListingPage(t *testing.T) {
+	items, skipped, rowCount, err := parseListingPage(loadDocument(t, "testdata/ccan_listing.html"), 3)
+	if err != nil {
+		t.Fatalf("parsing listing: %s", err.Error())
+	}
+	if rowCount != 3 || len(items) != 2 {
+		t.Fatalf("got %d items from %d rows, expected 2 items from 3 rows", len(items), rowCount)
+	}
+
+	if len(skipped) != 1 {
+		t.Fatalf("expected one skipped row, got %d", len(skipped))
+	}
+	if skipped[0].Page != 3 || skipped[0].Rule != "missing download link" || !strings.Contains(skipped[0].HTML, "Broken") {
+		t.Errorf("unexpected skipped row %+v", skipped[0])
+	}
+
+	expected := CCANItem{
+		Type:          "Szenario",
+		Name:          "Western & Co",
+		Date:          time.Date(2009, 12, 24, 18, 30, 0, 0, time.UTC),
+		DownloadCount: 345,
+		Author:        "Sven2",
+		Votes:         12,
+		Category:      "Melee",
+		Engine:        "CR",
+		DownloadLink:  "https://ccan.de/cgi-bin/ccan/ccan-dl.pl?id=4711",
+		Size:          1258291,
+	}
+	if items[0] != expected {
+		t.Errorf("got %+v, expected %+v", items[0], expected)
+	}
+	if items[1].DownloadLink != "https://ccan.de/cgi-bin/ccan/ccan-dl.pl?id=13" {
+		t.Errorf("absolute link was changed to %s", items[1].DownloadLink)
+	}
+}
+
+func TestParseListingPageLayoutChanged(t *testing.T) {
+	doc, err := goquery.NewDocumentFromReader(strings.NewReader(`<table><tr><th>Titel</th><th>Download</th><th>Kategorie</th></tr></table>`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, _, _, err = parseListingPage(doc, 0)
+	if err == nil || !strings.Contains(err.Error(), `expected column "autor"`) {
+		t.Fatalf("expected error about missing author column, got %v", err)
+	}
+	if !errors.Is(&LayoutError{Err: err}, ErrAborted) {
+		t.Errorf("layout errors should abort the crawl")
+	}
+}
+
+func TestParseListingPageUnlabeledColumns(t *testing.T) {
+	// The download column has no header and the engine column an unknown one, so both are found by their position
+	doc, err := goquery.NewDocumentFromReader(strings.NewReader(`<table>
+<tr><th>Typ</th><th>Titel</th><th></th><th>Kategorie</th><th>Autor</th><th>Ver.</th><th>Stimmen</th><th>Downloads</th><th>Größe</th><th>Datum</th></tr>
+<tr><td>Szenario</td><td>Western</td><td><a href="ccan-dl.pl?id=1">Laden</a></td><td>Melee</td><td>Sven2</td><td>CR</td><td>3</td><td>4</td><td>1 KB</td><td>24.12.09 18:30</td></tr>
+</table>`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	items, skipped, _, err := parseListingPage(doc, 0)
+	if err != nil {
+		t.Fatalf("parsing listing: %s", err.Error())
+	}
+	if len(items) != 1 || len(skipped) != 0 {
+		t.Fatalf("got %d items and %d skipped rows, expected one item", len(items), len(skipped))
+	}
+	if items[0].DownloadLink != "https://ccan.de/cgi-bin/ccan/ccan-dl.pl?id=1" || items[0].Engine != "CR" {
+		t.Errorf("unlabeled columns were not found by position: %+v", items[0])
+	}
+}
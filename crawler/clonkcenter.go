@@ -1,7 +1,10 @@
 package crawler
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"net/http"
 	"regexp"
 	"strconv"
 	"strings"
@@ -16,12 +19,13 @@ import (
 const (
 	urlTemplate         = "https://cc-archive.lwrl.de/download.php?act=getinfo&dl=%d"
 	ccDateFormat string = "02.01.2006 15:04:05" // e.g. 30.06.2004 21:02
-
-	maxItemID = 643 // The newest item has the id 643, and there don't seem to be more after it (404 for all above it)
 )
 
 var (
 	downloadCountRe = regexp.MustCompile(`\((\d+) mal runtergeladen\)`)
+
+	// ratingRe matches ratings like "4,5 (12 Stimmen)" or "3/5 (1 Bewertung)"
+	ratingRe = regexp.MustCompile(`^([\d.,]+)[^(]*\(\s*(\d+)\D*\)`)
 )
 
 // CCItem is an item from Clonk Center - Everything will be downloaded from the archive at https://cc-archive.lwrl.de/
@@ -34,6 +38,17 @@ type CCItem struct {
 	Engine        string    `json:"engine"`
 	DownloadLink  string    `json:"download_link"`
 	Description   string    `json:"description"`
+	Size          int64     `json:"size"` // in bytes, 0 if unknown
+	Rating        CCRating  `json:"rating"`
+
+	// Extra contains all fields of the info page that couldn't be parsed, so no information is lost
+	Extra map[string]string `json:"extra,omitempty"`
+}
+
+// CCRating is the rating of a Clonk-Center item
+type CCRating struct {
+	Score float64 `json:"score"`
+	Votes int     `json:"votes"`
 }
 
 // Implement zipfactory.Archivable
@@ -54,39 +69,194 @@ func (c CCItem) GetSourceName() string {
 	return "Clonk-Center"
 }
 
-// CrawlClonkCenter gets all items by incrementing a number and returning the items at the corresponding urls - it doesn't close the `output` channel
-func CrawlClonkCenter(output chan zipfactory.Archivable) (errorlist []error) {
-	var currentItemID = 1 // 0 will return 404
+// GetDate implements zipfactory.Dated
+func (c CCItem) GetDate() time.Time {
+	return c.Date
+}
+
+const clonkCenterSourceName = "clonk-center"
+
+// clonkCenterSource is the Source for the Clonk-Center archive
+type clonkCenterSource struct {
+	opts Options
+}
+
+func (*clonkCenterSource) Name() string {
+	return clonkCenterSourceName
+}
+
+func (*clonkCenterSource) Description() string {
+	return "cc-archive.lwrl.de"
+}
+
+func (c *clonkCenterSource) Configure(opts Options) {
+	c.opts = opts
+}
+
+func (c *clonkCenterSource) Crawl(ctx context.Context, output chan<- zipfactory.Archivable) error {
+	return ErrorList(CrawlClonkCenter(ctx, output, c.opts)).Err()
+}
+
+// ClonkCenterOptions configures how item ids of the Clonk-Center archive are discovered
+type ClonkCenterOptions struct {
+	// LastKnownID is the highest id that is known to exist. All ids up to it are always crawled
+	LastKnownID int
+
+	// MaxMissing is the number of consecutive ids after the highest known id that must be missing before the crawl ends
+	MaxMissing int
+
+	// SeedURLs are pages of the archive that link to info pages. The ids of all linked items are crawled,
+	// even if they are way above LastKnownID
+	SeedURLs []string
+}
+
+// DefaultClonkCenterOptions probes 50 ids after the newest known item
+var DefaultClonkCenterOptions = ClonkCenterOptions{
+	LastKnownID: 643, // The newest item has the id 643, and there don't seem to be more after it (404 for all above it)
+	MaxMissing:  50,
+}
+
+// ItemError is returned if the info page of an item could not be loaded
+type ItemError struct {
+	ID int
+
+	// NotFound is set if the server said that the item doesn't exist, otherwise this was a transient failure
+	NotFound bool
+
+	Err error
+}
+
+func (i *ItemError) Error() string {
+	if i.NotFound {
+		return fmt.Sprintf("Item %d does not exist", i.ID)
+	}
+	return fmt.Sprintf("Failed to load item %d: %s", i.ID, i.Err.Error())
+}
+
+func (i *ItemError) Unwrap() error {
+	return i.Err
+}
+
+// CrawlClonkCenter gets all items by incrementing a number and returning the items at the corresponding urls - it doesn't close the `output` channel.
+// After the highest known id (see ClonkCenterOptions), it continues until opts.ClonkCenter.MaxMissing ids in a row didn't return an item.
+// Up to opts.Workers pages are loaded at the same time, but items are always sent in the order of their ids. It stops early if ctx is done
+func CrawlClonkCenter(ctx context.Context, output chan<- zipfactory.Archivable, opts Options) (errorlist []error) {
+	var ccOpts = opts.ClonkCenter
+
+	var lastKnownID = ccOpts.LastKnownID
+	seeded, errs := seedClonkCenterIDs(ctx, opts.Fetcher, ccOpts.SeedURLs)
+	errorlist = append(errorlist, errs...)
+	for _, id := range seeded {
+		if id > lastKnownID {
+			lastKnownID = id
+		}
+	}
+
+	var missingInARow int
+	runOrdered(ctx, opts.Workers, 1, func(ctx context.Context, id int) interface{} { // 0 will return 404
+		// Item ids never change, so items that have been archived in an earlier run can be skipped
+		if opts.Journal != nil && opts.Journal.PageDone(clonkCenterSourceName, id) {
+			return ccItemResult{archived: true}
+		}
+		item, err := GetClonkCenterItem(ctx, opts.Fetcher, id)
+		return ccItemResult{item: item, err: err}
+	}, func(id int, result interface{}) bool {
+		res := result.(ccItemResult)
+		if ctx.Err() != nil {
+			return false
+		}
+
+		if res.archived {
+			missingInARow = 0
+			return true
+		}
+		if res.err == nil {
+			missingInARow = 0
+			if opts.Journal != nil {
+				opts.Journal.PageCrawled(clonkCenterSourceName, id, []string{res.item.DownloadLink})
+			}
+			return sendItem(ctx, output, res.item) == nil
+		}
+
+		var status *StatusError
+		itemErr := &ItemError{
+			ID:       id,
+			NotFound: errors.As(res.err, &status) && status.StatusCode == http.StatusNotFound,
+			Err:      res.err,
+		}
+
+		if id <= lastKnownID {
+			errorlist = append(errorlist, itemErr)
+		} else {
+			// After the last known id, everything that doesn't return an item is counted as missing.
+			// Only transient failures are reported, we expect ids after the newest item to not exist
+			missingInARow++
+			if !itemErr.NotFound {
+				errorlist = append(errorlist, itemErr)
+			}
+		}
+
+		return id+1 <= lastKnownID || missingInARow < ccOpts.MaxMissing
+	})
+
+	if ctx.Err() != nil {
+		errorlist = append(errorlist, ctx.Err())
+	}
+	return
+}
+
+// ccItemResult is the result of GetClonkCenterItem
+type ccItemResult struct {
+	item CCItem
+	err  error
+
+	// archived is set if the item was skipped because it was archived in an earlier run
+	archived bool
+}
+
+var infoLinkIDRe = regexp.MustCompile(`act=getinfo&(?:amp;)?dl=(\d+)`)
 
-	for currentItemID < maxItemID+1 {
-		item, err := GetClonkCenterItem(currentItemID)
+// seedClonkCenterIDs returns the ids of all items that are linked on the pages at seedURLs
+func seedClonkCenterIDs(ctx context.Context, f *Fetcher, seedURLs []string) (ids []int, errorlist []error) {
+	for _, seedURL := range seedURLs {
+		content, err := f.Open(ctx, seedURL)
 		if err != nil {
-			errorlist = append(errorlist, fmt.Errorf("Error while downloading page %d: %s", currentItemID, err.Error()))
-			currentItemID++
+			errorlist = append(errorlist, fmt.Errorf("Error while loading seed page %s: %w", seedURL, err))
 			continue
 		}
 
-		output <- item
-		currentItemID++
+		doc, err := goquery.NewDocumentFromReader(content)
+		_ = content.Close()
+		if err != nil {
+			errorlist = append(errorlist, fmt.Errorf("Error while reading seed page %s: %w", seedURL, err))
+			continue
+		}
 
-		// Sleep one second in order to respect the server - don't ddos it
-		time.Sleep(time.Second)
+		doc.Find("a[href]").Each(func(_ int, a *goquery.Selection) {
+			matches := infoLinkIDRe.FindStringSubmatch(a.AttrOr("href", ""))
+			if len(matches) != 2 {
+				return
+			}
+			if id, err := strconv.Atoi(matches[1]); err == nil {
+				ids = append(ids, id)
+			}
+		})
 	}
-
 	return
 }
 
-func GetClonkCenterItem(id int) (result CCItem, err error) {
-	content, err := DoRequest(fmt.Sprintf(urlTemplate, id))
+// GetClonkCenterItem downloads and parses the info page of the item with the given id using f
+func GetClonkCenterItem(ctx context.Context, f *Fetcher, id int) (result CCItem, err error) {
+	content, err := f.Open(ctx, fmt.Sprintf(urlTemplate, id))
 	if err != nil {
-		return result, fmt.Errorf("Error while downloading page %d: %s", id, err.Error())
+		return result, fmt.Errorf("Error while downloading page %d: %w", id, err)
 	}
+	defer content.Close()
 
 	doc, err := goquery.NewDocumentFromReader(content)
 	if err != nil {
 		return result, fmt.Errorf("Error while reading page content %d: %s", id, err.Error())
 	}
-	_ = content.Close()
 
 	doc.Find("table.fullgrid > tbody > *").Each(func(i int, s *goquery.Selection) {
 		if goquery.NodeName(s) != "tr" {
@@ -153,13 +323,55 @@ func GetClonkCenterItem(id int) (result CCItem, err error) {
 				// Convert this html to markdown
 				result.Description = whitefriday.Convert(htmlString)
 			}
-		default:
-			if key != "Dateigröße" && key != "Bewertung" {
-				fmt.Printf("Unknown field \"%s\" encountered\n", key)
+		case "Dateigröße":
+			size, err := parseFileSize(value.Text())
+			if err != nil {
+				result.addExtra(key, value.Text())
+				return
 			}
+			result.Size = size
+		case "Bewertung":
+			rating, ok := parseRating(value.Text())
+			if !ok {
+				result.addExtra(key, value.Text())
+				return
+			}
+			result.Rating = rating
+		default:
+			result.addExtra(key, value.Text())
 		}
 
 	})
 
 	return result, nil
 }
+
+// addExtra stores a field that couldn't be parsed
+func (c *CCItem) addExtra(key, value string) {
+	if strings.TrimSpace(key) == "" && strings.TrimSpace(value) == "" {
+		return
+	}
+	if c.Extra == nil {
+		c.Extra = make(map[string]string)
+	}
+	c.Extra[strings.TrimSpace(key)] = strings.TrimSpace(value)
+}
+
+// parseRating parses the "Bewertung" field of an info page
+func parseRating(input string) (rating CCRating, ok bool) {
+	matches := ratingRe.FindStringSubmatch(strings.TrimSpace(input))
+	if matches == nil {
+		return rating, false
+	}
+
+	score, err := strconv.ParseFloat(strings.Replace(matches[1], ",", ".", 1), 64)
+	if err != nil {
+		return rating, false
+	}
+	votes, err := strconv.Atoi(matches[2])
+	if err != nil {
+		return rating, false
+	}
+
+	return CCRating{Score: score, Votes: votes}, true
+}
@@ -0,0 +1,23 @@
+package crawler
+
+import "testing"
+
+func TestParseRating(t *testing.T) {
+	table := map[string]CCRating{
+		"4,5 (12 Stimmen)":     {Score: 4.5, Votes: 12},
+		"3/5 (1 Bewertung)":    {Score: 3, Votes: 1},
+		" 2.25 ( 7 Stimmen ) ": {Score: 2.25, Votes: 7},
+		"0 (0 Stimmen)":        {Score: 0, Votes: 0},
+	}
+
+	for key, value := range table {
+		res, ok := parseRating(key)
+		if !ok || res != value {
+			t.Errorf("`%s`=`%+v` (ok: %v), expected `%+v`", key, res, ok, value)
+		}
+	}
+
+	if _, ok := parseRating("Noch nicht bewertet"); ok {
+		t.Errorf("expected unrated item to fail")
+	}
+}
@@ -0,0 +1,247 @@
+package crawler_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/xarantolus/ccan-archiver/crawler"
+	"github.com/xarantolus/ccan-archiver/crawler/crawlertest"
+	"github.com/xarantolus/ccan-archiver/zipfactory"
+)
+
+var testCCANItems = []crawler.CCANItem{
+	{Type: "Szenario", Name: "Western", Date: time.Date(2009, 12, 24, 18, 30, 0, 0, time.UTC), DownloadCount: 345, Author: "Sven2", Votes: 12, Category: "Melee", Engine: "CR", DownloadLink: "https://ccan.de/cgi-bin/ccan/ccan-dl.pl?id=1", Size: 1024},
+	{Type: "Objekte", Name: "Hazard Pack", Date: time.Date(2004, 3, 2, 9, 15, 0, 0, time.UTC), DownloadCount: 89, Author: "Matthi", Votes: 7, Category: "Objects", Engine: "CE", DownloadLink: "https://ccan.de/cgi-bin/ccan/ccan-dl.pl?id=2", Size: 512},
+	{Type: "Szenario", Name: "Stippel & Co", Date: time.Date(2003, 1, 1, 12, 0, 0, 0, time.UTC), DownloadCount: 5, Author: "Newton", Votes: 1, Category: "Race", Engine: "CP", DownloadLink: "https://ccan.de/cgi-bin/ccan/ccan-dl.pl?id=3", Size: 2048},
+}
+
+// crawlCCAN runs CrawlCCAN and returns all items from the listing, without the ones that were added manually
+func crawlCCAN(t *testing.T, opts crawler.Options) (items []crawler.CCANItem, errs []error) {
+	var output = make(chan zipfactory.Archivable)
+	go func() {
+		errs = crawler.CrawlCCAN(context.Background(), output, opts)
+		close(output)
+	}()
+
+	for item := range output {
+		if strings.HasPrefix(item.GetDownloadLink(), "https://ccan.de/") {
+			items = append(items, item.(crawler.CCANItem))
+		}
+	}
+	return
+}
+
+func TestCrawlCCAN(t *testing.T) {
+	srv := crawlertest.NewServer()
+	defer srv.Close()
+	srv.CCANItems = testCCANItems
+	srv.PageSize = 2
+
+	opts := crawler.DefaultOptions()
+	opts.Fetcher = srv.Fetcher()
+
+	items, errs := crawlCCAN(t, opts)
+	if len(errs) != 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+	if len(items) != len(testCCANItems) {
+		t.Fatalf("got %d items, expected %d", len(items), len(testCCANItems))
+	}
+	for i, item := range items {
+		if item != testCCANItems[i] {
+			t.Errorf("item %d: got %+v, expected %+v", i, item, testCCANItems[i])
+		}
+	}
+
+	// The second page contains an item from before 2005, so the items of the third page are not sent
+	opts.CCANStopBefore = time.Date(2005, 1, 1, 0, 0, 0, 0, time.UTC)
+	srv.PageSize = 1
+	if items, _ = crawlCCAN(t, opts); len(items) != 2 {
+		t.Errorf("expected the crawl to stop after 2 items, got %d", len(items))
+	}
+}
+
+func TestGetClonkCenterItem(t *testing.T) {
+	srv := crawlertest.NewServer()
+	defer srv.Close()
+
+	expected := crawler.CCItem{
+		Name:          "Clonk Endeavour",
+		Date:          time.Date(2004, 6, 30, 21, 2, 0, 0, time.UTC),
+		Author:        "Redwolf Design",
+		PostedBy:      "Admin",
+		DownloadCount: 1234,
+		Engine:        "CE",
+		DownloadLink:  "https://cc-archive.lwrl.de/download.php?act=download&dl=5",
+		Description:   "The last Clonk",
+		Size:          1536,
+		Rating:        crawler.CCRating{Score: 4.5, Votes: 12},
+		Extra:         map[string]string{"Lizenz": "Freeware"},
+	}
+	srv.CCItems[5] = expected
+
+	item, err := crawler.GetClonkCenterItem(context.Background(), srv.Fetcher(), 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The markdown conversion of the description adds some newlines
+	item.Description = strings.TrimSpace(item.Description)
+	if !reflect.DeepEqual(item, expected) {
+		t.Errorf("got %+v, expected %+v", item, expected)
+	}
+
+	if _, err = crawler.GetClonkCenterItem(context.Background(), srv.Fetcher(), 6); err == nil {
+		t.Errorf("expected error for missing item")
+	}
+}
+
+func TestCassette(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cassette")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	srv := crawlertest.NewServer()
+	srv.CCANItems = testCCANItems
+
+	opts := crawler.DefaultOptions()
+	opts.Fetcher = srv.Fetcher()
+	opts.Fetcher.Client = &http.Client{Transport: &crawler.Cassette{Dir: dir, Mode: crawler.Record, Transport: srv.Transport()}}
+
+	recorded, errs := crawlCCAN(t, opts)
+	if len(errs) != 0 {
+		t.Fatalf("unexpected errors while recording: %v", errs)
+	}
+
+	// Replaying must work without the server
+	srv.Close()
+	opts.Fetcher.Client = &http.Client{Transport: &crawler.Cassette{Dir: dir, Mode: crawler.Replay}}
+
+	replayed, errs := crawlCCAN(t, opts)
+	if len(errs) != 0 {
+		t.Fatalf("unexpected errors while replaying: %v", errs)
+	}
+	if len(replayed) != len(recorded) || len(replayed) != len(testCCANItems) {
+		t.Fatalf("replayed %d items, recorded %d", len(replayed), len(recorded))
+	}
+}
+
+func TestCrawlClonkCenterDiscovery(t *testing.T) {
+	srv := crawlertest.NewServer()
+	defer srv.Close()
+
+	for _, id := range []int{1, 2, 5, 9, 20} {
+		srv.CCItems[id] = crawler.CCItem{Name: fmt.Sprintf("Item %d", id), DownloadLink: fmt.Sprintf("https://cc-archive.lwrl.de/download.php?act=download&dl=%d", id)}
+	}
+	srv.Files["https://cc-archive.lwrl.de/download.php?act=list"] = []byte(`<a href="download.php?act=getinfo&amp;dl=20">Item 20</a>`)
+
+	opts := crawler.DefaultOptions()
+	opts.Fetcher = srv.Fetcher()
+	opts.ClonkCenter = crawler.ClonkCenterOptions{LastKnownID: 3, MaxMissing: 3}
+
+	crawl := func() (names []string, errs []error) {
+		var output = make(chan zipfactory.Archivable)
+		go func() {
+			errs = crawler.CrawlClonkCenter(context.Background(), output, opts)
+			close(output)
+		}()
+		for item := range output {
+			names = append(names, item.GetName())
+		}
+		return
+	}
+
+	// Item 9 comes after 3 missing ids (6, 7, 8), so it is not found
+	names, errs := crawl()
+	if strings.Join(names, ",") != "Item 1,Item 2,Item 5" {
+		t.Errorf("got items %v", names)
+	}
+	if len(errs) != 1 {
+		t.Fatalf("expected one error for id 3, got %v", errs)
+	}
+	if itemErr, ok := errs[0].(*crawler.ItemError); !ok || itemErr.ID != 3 || !itemErr.NotFound {
+		t.Errorf("expected id 3 to not exist, got %v", errs[0])
+	}
+
+	// The seed page links to item 20, so everything up to it is crawled
+	opts.ClonkCenter.SeedURLs = []string{"https://cc-archive.lwrl.de/download.php?act=list"}
+	names, _ = crawl()
+	if strings.Join(names, ",") != "Item 1,Item 2,Item 5,Item 9,Item 20" {
+		t.Errorf("got items %v with seeding", names)
+	}
+
+	// Items that were archived in an earlier run are skipped without loading their info page
+	journal := testJournal{crawled: make(map[int][]string), done: make(map[int]bool)}
+	opts.Journal = journal
+	opts.ClonkCenter.SeedURLs = nil
+	crawl()
+	if links := journal.crawled[5]; len(links) != 1 || !strings.HasSuffix(links[0], "dl=5") {
+		t.Errorf("expected item 5 to be recorded, got %v", journal.crawled)
+	}
+	journal.done[2] = true
+	names, _ = crawl()
+	if strings.Join(names, ",") != "Item 1,Item 5" {
+		t.Errorf("got items %v with journal", names)
+	}
+}
+
+// testJournal is a crawler.PageJournal where pages are done after they were set in done
+type testJournal struct {
+	crawled map[int][]string
+	done    map[int]bool
+}
+
+func (j testJournal) PageCrawled(source string, page int, links []string) {
+	j.crawled[page] = links
+}
+
+func (j testJournal) PageDone(source string, page int) bool {
+	return j.done[page] && source == "clonk-center"
+}
+
+// roundTripFunc is an http.RoundTripper that calls itself
+type roundTripFunc func(req *http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestCrawlCCANSiteDown(t *testing.T) {
+	var requests int64
+	opts := crawler.DefaultOptions()
+	opts.Fetcher = crawler.NewFetcher()
+	opts.Fetcher.MinBackoff, opts.Fetcher.MaxBackoff, opts.Fetcher.Limiter = 0, 0, nil
+	opts.Fetcher.Client = &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		atomic.AddInt64(&requests, 1)
+		return &http.Response{StatusCode: http.StatusServiceUnavailable, Body: ioutil.NopCloser(strings.NewReader("")), Request: req}, nil
+	})}
+	opts.ErrorPolicy = crawler.ErrorPolicy{Backoff: nil, OnPageFailure: crawler.SkipPage}
+
+	var done = make(chan []error, 1)
+	go func() {
+		_, errs := crawlCCAN(t, opts)
+		done <- errs
+	}()
+
+	select {
+	case errs := <-done:
+		if len(errs) == 0 || !errors.Is(errs[len(errs)-1], crawler.ErrAborted) {
+			t.Errorf("expected the crawl to be aborted, got %v", errs)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("the crawl doesn't stop while the site is down")
+	}
+	if n := atomic.LoadInt64(&requests); n > 100 {
+		t.Errorf("expected the crawl to stop after a few pages, but it made %d requests", n)
+	}
+}
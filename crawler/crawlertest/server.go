@@ -0,0 +1,179 @@
+// Package crawlertest provides a fake ccan.de and Clonk-Center archive for testing crawlers without network access
+package crawlertest
+
+import (
+	"html/template"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/xarantolus/ccan-archiver/crawler"
+)
+
+const (
+	ccanHost = "ccan.de"
+	ccHost   = "cc-archive.lwrl.de"
+	ccPrefix = "https://cc-archive.lwrl.de/"
+)
+
+// Server is a fake version of ccan.de and cc-archive.lwrl.de. Requests for these hosts are routed to it by Transport.
+// The fields may only be changed before the first request
+type Server struct {
+	*httptest.Server
+
+	// CCANItems are shown in the ccan.de listing, PageSize items per page
+	CCANItems []crawler.CCANItem
+	PageSize  int
+
+	// CCItems maps Clonk-Center ids to their items, all other ids return 404
+	CCItems map[int]crawler.CCItem
+
+	// Files maps absolute urls to the content that is served for them, e.g. for download links
+	Files map[string][]byte
+
+	lock     sync.Mutex
+	requests []string
+}
+
+// NewServer starts a new fake server. It must be closed after use
+func NewServer() *Server {
+	s := &Server{
+		PageSize: 250,
+		CCItems:  make(map[int]crawler.CCItem),
+		Files:    make(map[string][]byte),
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serve))
+	return s
+}
+
+// Transport returns a RoundTripper that sends all requests to the fake server, no matter which host they are for
+func (s *Server) Transport() http.RoundTripper {
+	return rewriteTransport{target: s.Listener.Addr().String()}
+}
+
+// Fetcher returns a crawler.Fetcher that uses Transport and neither waits before retrying nor limits requests
+func (s *Server) Fetcher() *crawler.Fetcher {
+	f := crawler.NewFetcher()
+	f.Client = &http.Client{Transport: s.Transport()}
+	f.MinBackoff, f.MaxBackoff = 0, 0
+	f.Limiter = nil
+	return f
+}
+
+// Requests returns the urls of all requests the server has received
+func (s *Server) Requests() []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return append([]string{}, s.requests...)
+}
+
+// rewriteTransport sends requests to target while keeping the original Host header
+type rewriteTransport struct {
+	target string
+}
+
+func (r rewriteTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	rewritten := req.Clone(req.Context())
+	rewritten.Host = req.URL.Host
+	rewritten.URL.Scheme = "http"
+	rewritten.URL.Host = r.target
+	return http.DefaultTransport.RoundTrip(rewritten)
+}
+
+func (s *Server) serve(w http.ResponseWriter, r *http.Request) {
+	original := "https://" + r.Host + r.URL.RequestURI()
+
+	s.lock.Lock()
+	s.requests = append(s.requests, original)
+	s.lock.Unlock()
+
+	switch {
+	case r.Host == ccanHost && r.URL.Path == "/cgi-bin/ccan/ccan-view.pl":
+		s.serveListing(w, r)
+	case r.Host == ccHost && r.URL.Path == "/download.php" && r.URL.Query().Get("act") == "getinfo":
+		s.serveInfoPage(w, r)
+	default:
+		content, ok := s.Files[original]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+		w.Write(content)
+	}
+}
+
+var listingTemplate = template.Must(template.New("listing").Parse(`<html>
+<head><title>CCAN</title></head>
+<body>
+<form action="ccan-view.pl">
+<table>
+<tr><th>Typ</th><th>Titel</th><th>Download</th><th>Kategorie</th><th>Autor</th><th>Engine</th><th>Stimmen</th><th>Downloads</th><th>Größe</th><th>Datum</th></tr>
+{{range .}}<tr><td><img src="type.gif" alt="{{.Type}}"></td><td><b>{{.Name}}</b></td><td><a href="{{.DownloadLink}}">Laden</a></td><td><i>{{.Category}}</i></td><td><a href="ccan-view.pl?a={{.Author}}">{{.Author}}</a></td><td>{{.Engine}}</td><td>{{.Votes}}</td><td>{{.DownloadCount}}</td><td>{{.Size}} Bytes</td><td>{{.Date.Format "02.01.06 15:04"}}</td></tr>
+{{end}}</table>
+</form>
+</body>
+</html>`))
+
+func (s *Server) serveListing(w http.ResponseWriter, r *http.Request) {
+	page, err := strconv.Atoi(r.URL.Query().Get("pg"))
+	if err != nil {
+		http.Error(w, "invalid page", http.StatusBadRequest)
+		return
+	}
+
+	var items []crawler.CCANItem
+	if start := page * s.PageSize; start < len(s.CCANItems) {
+		end := start + s.PageSize
+		if end > len(s.CCANItems) {
+			end = len(s.CCANItems)
+		}
+		items = s.CCANItems[start:end]
+	}
+
+	if err := listingTemplate.Execute(w, items); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+var infoTemplate = template.Must(template.New("info").Parse(`<html>
+<body>
+<table class="fullgrid">
+<tr class="header"><td colspan="2">{{.Name}}</td></tr>
+<tr><td>Datum</td><td>{{.Date.Format "02.01.2006 15:04:05"}}</td></tr>
+<tr><td>Autor</td><td><a href="profile.php">{{.Author}}</a></td></tr>
+<tr><td>Gepostet von</td><td>{{.PostedBy}}</td></tr>
+<tr><td>Engine-Version</td><td>{{.Engine}}</td></tr>
+<tr><td>Download</td><td><a href="{{.Link}}">Download</a> ({{.DownloadCount}} mal runtergeladen)</td></tr>
+<tr><td>Dateigröße</td><td>{{.Size}} Bytes</td></tr>
+<tr><td>Bewertung</td><td>{{.Rating.Score}} ({{.Rating.Votes}} Stimmen)</td></tr>
+<tr><td>Beschreibung</td><td><p>{{.Description}}</p></td></tr>
+{{range $key, $value := .Extra}}<tr><td>{{$key}}</td><td>{{$value}}</td></tr>
+{{end}}</table>
+</body>
+</html>`))
+
+func (s *Server) serveInfoPage(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.URL.Query().Get("dl"))
+	if err != nil {
+		http.Error(w, "invalid id", http.StatusBadRequest)
+		return
+	}
+
+	item, ok := s.CCItems[id]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	err = infoTemplate.Execute(w, struct {
+		crawler.CCItem
+		Link string
+	}{item, strings.TrimPrefix(item.DownloadLink, ccPrefix)})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
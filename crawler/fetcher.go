@@ -0,0 +1,201 @@
+package crawler
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// DefaultUserAgent is sent with all requests if Fetcher.UserAgent is empty
+const DefaultUserAgent = "ccan-archiver (+https://github.com/xarantolus/ccan-archiver)"
+
+// Fetcher downloads pages and files. It reuses connections and retries requests that failed with
+// a network error, a timeout or a 5xx/429 status code using exponential backoff.
+// A Fetcher can be copied to change settings while still sharing its connections
+type Fetcher struct {
+	Client    *http.Client
+	UserAgent string
+
+	// Timeout limits each attempt, including reading the response body. 0 means no timeout
+	Timeout time.Duration
+
+	// MaxRetries is the number of times a request is repeated after the first attempt failed
+	MaxRetries int
+	// MinBackoff is the delay before the first retry, it doubles with each retry up to MaxBackoff.
+	// The actual delay is randomized to be between half and all of that value
+	MinBackoff, MaxBackoff time.Duration
+
+	// Limiter limits requests per host if it is set. A request counts as in flight until its body is closed
+	Limiter *HostLimiter
+}
+
+// NewFetcher returns a Fetcher with a pooled transport and defaults suitable for listing pages
+func NewFetcher() *Fetcher {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConnsPerHost = 8
+
+	return &Fetcher{
+		Client:     &http.Client{Transport: transport},
+		UserAgent:  DefaultUserAgent,
+		Timeout:    2 * time.Minute,
+		MaxRetries: 3,
+		MinBackoff: time.Second,
+		MaxBackoff: time.Minute,
+		Limiter:    NewHostLimiter(4, 4),
+	}
+}
+
+// DefaultFetcher is used by DoRequest and by sources that were not configured otherwise
+var DefaultFetcher = NewFetcher()
+
+// StatusError is returned if the server responded with an unexpected status code
+type StatusError struct {
+	URL        string
+	StatusCode int
+}
+
+func (s *StatusError) Error() string {
+	return fmt.Sprintf("Error in http request to %s: StatusCode is %d", s.URL, s.StatusCode)
+}
+
+// Get requests url and returns the response if its status code indicates success.
+// The caller must close the response body
+func (f *Fetcher) Get(ctx context.Context, url string) (resp *http.Response, err error) {
+	for attempt := 0; ; attempt++ {
+		var retryAfter time.Duration
+		resp, retryAfter, err = f.try(ctx, url)
+		if err == nil || ctx.Err() != nil || attempt >= f.MaxRetries {
+			return
+		}
+		if status, ok := err.(*StatusError); ok && !retryableStatus(status.StatusCode) {
+			return
+		}
+
+		if retryAfter == 0 {
+			retryAfter = f.backoff(attempt)
+		}
+		if serr := sleep(ctx, retryAfter); serr != nil {
+			return nil, serr
+		}
+	}
+}
+
+// Open requests url and returns the response body
+func (f *Fetcher) Open(ctx context.Context, url string) (io.ReadCloser, error) {
+	resp, err := f.Get(ctx, url)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// try does a single attempt. If the server asked us to come back later, retryAfter is set
+func (f *Fetcher) try(ctx context.Context, url string) (resp *http.Response, retryAfter time.Duration, err error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var release = func() {}
+	if f.Limiter != nil {
+		if release, err = f.Limiter.Acquire(ctx, req.URL.Host); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	// The timeout starts after waiting for the limiter
+	var cancel = func() {}
+	if f.Timeout > 0 {
+		var timeoutCtx context.Context
+		timeoutCtx, cancel = context.WithTimeout(ctx, f.Timeout)
+		req = req.WithContext(timeoutCtx)
+	}
+	var done = func() {
+		cancel()
+		release()
+	}
+
+	ua := f.UserAgent
+	if ua == "" {
+		ua = DefaultUserAgent
+	}
+	req.Header.Set("User-Agent", ua)
+
+	client := f.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	resp, err = client.Do(req)
+	if err != nil {
+		done()
+		return nil, 0, err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 399 {
+		retryAfter = parseRetryAfter(resp.Header.Get("Retry-After"), f.MaxBackoff)
+
+		_ = resp.Body.Close()
+		done()
+		return nil, retryAfter, &StatusError{URL: url, StatusCode: resp.StatusCode}
+	}
+
+	// The timeout must only be cancelled once the body has been read
+	resp.Body = closeHook{resp.Body, done}
+
+	return resp, 0, nil
+}
+
+// backoff returns the randomized delay before retry number attempt+1
+func (f *Fetcher) backoff(attempt int) time.Duration {
+	d := f.MinBackoff << uint(attempt)
+	if d > f.MaxBackoff || d <= 0 {
+		d = f.MaxBackoff
+	}
+	if d <= 0 {
+		return 0
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+func retryableStatus(code int) bool {
+	return code == http.StatusTooManyRequests || code >= 500
+}
+
+// parseRetryAfter parses the value of a Retry-After header, which can either be seconds or a date.
+// Servers sometimes send absurd values, so the result is capped at max if max is positive
+func parseRetryAfter(header string, max time.Duration) (d time.Duration) {
+	if header == "" {
+		return 0
+	}
+
+	if secs, err := strconv.Atoi(header); err == nil {
+		d = time.Duration(secs) * time.Second
+	} else if t, err := http.ParseTime(header); err == nil {
+		d = time.Until(t)
+	}
+
+	if d < 0 {
+		d = 0
+	}
+	if max > 0 && d > max {
+		d = max
+	}
+	return
+}
+
+// closeHook calls done after closing the body
+type closeHook struct {
+	io.ReadCloser
+	done func()
+}
+
+func (c closeHook) Close() error {
+	err := c.ReadCloser.Close()
+	c.done()
+	return err
+}
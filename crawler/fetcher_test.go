@@ -0,0 +1,111 @@
+package crawler
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestFetcherRetries(t *testing.T) {
+	var requests int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.Header.Get("User-Agent") != "test-agent" {
+			t.Errorf("unexpected User-Agent %q", r.Header.Get("User-Agent"))
+		}
+
+		switch requests {
+		case 1:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		case 2:
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+		default:
+			w.Write([]byte("ok"))
+		}
+	}))
+	defer srv.Close()
+
+	f := NewFetcher()
+	f.UserAgent = "test-agent"
+	f.MinBackoff = time.Millisecond
+	f.MaxBackoff = 10 * time.Millisecond // also caps Retry-After
+
+	body, err := f.Open(context.Background(), srv.URL)
+	if err != nil {
+		t.Fatalf("expected request to succeed after retrying, got %s", err.Error())
+	}
+	defer body.Close()
+
+	content, _ := ioutil.ReadAll(body)
+	if string(content) != "ok" || requests != 3 {
+		t.Errorf("got %q after %d requests, expected \"ok\" after 3", string(content), requests)
+	}
+}
+
+func TestFetcherNotFound(t *testing.T) {
+	var requests int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		http.NotFound(w, r)
+	}))
+	defer srv.Close()
+
+	_, err := NewFetcher().Get(context.Background(), srv.URL)
+	if status, ok := err.(*StatusError); !ok || status.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected StatusError with 404, got %v", err)
+	}
+	if requests != 1 {
+		t.Errorf("404 should not be retried, but there were %d requests", requests)
+	}
+}
+
+// brokenTransport responds with bodies that fail to read
+type brokenTransport struct{}
+
+func (brokenTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(brokenReader{}), Request: req}, nil
+}
+
+type brokenReader struct{}
+
+func (brokenReader) Read([]byte) (int, error) {
+	return 0, errors.New("connection reset")
+}
+
+func TestFetcherReleasesBrokenPages(t *testing.T) {
+	f := NewFetcher()
+	f.Client = &http.Client{Transport: brokenTransport{}}
+	f.MaxRetries = 0
+	f.Limiter = NewHostLimiter(0, 1)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// The second request only gets a slot if the first page was closed although it couldn't be read
+	for i := 0; i < 2; i++ {
+		if _, err := GetClonkCenterItem(ctx, f, 1); err == nil || ctx.Err() != nil {
+			t.Fatalf("request %d: expected read error, got %v (context: %v)", i+1, err, ctx.Err())
+		}
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	table := map[string]time.Duration{
+		"":        0,
+		"120":     2 * time.Minute,
+		"-5":      0,
+		"invalid": 0,
+		"100000":  time.Hour,
+	}
+
+	for key, value := range table {
+		if res := parseRetryAfter(key, time.Hour); res != value {
+			t.Errorf("`%s`=`%s`, expected `%s`", key, res, value)
+		}
+	}
+}
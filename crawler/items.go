@@ -1,102 +1,188 @@
 package crawler
 
+//go:generate go-bindata -pkg crawler -o items_manifest.go items.json
+
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
 	"time"
 )
 
-// This file fontains all additional items that aren't listed on ccan.de. This includes Freeware keys, linux and mac versions and US versions (only german games are linked)
-
-// Warning: All timestamps are estimates from listed date at the website (e.g. Published Year). They might be wrong
-var additionalItems = []CCANItem{
-	// Freeware Key for Clonk Endeavour; Copy this file to the directory that clonk.exe is installed in
-	CCANItem{
-		Name:          "Freeware",
-		Date:          time.Date(2004, 01, 01, 0, 0, 0, 0, time.Local),
-		DownloadCount: 1,
-		Author:        "Redwolf Design",
-		Votes:         0,
-		Category:      "Key",
-		Engine:        "CE",
-		DownloadLink:  "http://www.clonkx.de/endeavour/Freeware.c4k",
-	},
-
-	// Clonk Planet 'US' Version - only the German one is linked
-	CCANItem{
-		Name:          "Clonk Planet US",
-		Date:          time.Date(2000, 0, 0, 0, 0, 0, 0, time.Local), // Published in 2000
-		DownloadCount: 1,
-		Author:        "Redwolf Design",
-		Votes:         0,
-		Category:      "Engine",
-		Engine:        "CP",
-		DownloadLink:  "http://www.clonkx.de/planet/cp465us_free.exe",
-	},
-
-	// Freeware Key/Instructions for Clonk Planet
-	CCANItem{
-		Name:          "Freeware Key Clonk Planet DE",
-		Date:          time.Date(2000, 01, 01, 0, 0, 0, 0, time.Local),
-		DownloadCount: 1,
-		Author:        "Redwolf Design",
-		Votes:         0,
-		Category:      "Key",
-		Engine:        "CP",
-		DownloadLink:  "http://www.clonkx.de/planet/cp_freeware_de.txt",
-	},
-	CCANItem{
-		Name:          "Freeware Key Clonk Planet US",
-		Date:          time.Date(2000, 01, 01, 0, 0, 0, 0, time.Local),
-		DownloadCount: 1,
-		Author:        "Redwolf Design",
-		Votes:         0,
-		Category:      "Key",
-		Engine:        "CP",
-		DownloadLink:  "http://www.clonkx.de/planet/cp_freeware_us.txt",
-	},
-
-	// For Clonk Rage, only the Windows version is linked. The following items link the linux tar and mac zip so these versions will also be archived:
-	CCANItem{
-		Name:          "Clonk Rage Linux",
-		Date:          time.Date(2014, 5, 4, 23, 25, 52, 0, time.Local), // Last-Modified: Sun, 04 May 2014 23:25:52 GMT - time.Local is wrong but it's close enough i guess?
-		DownloadCount: 1,
-		Author:        "Redwolf Design",
-		Votes:         0,
-		Category:      "Engine",
-		Engine:        "CR",
-		DownloadLink:  "http://www.clonkx.de/rage/cr_full_linux.tar.bz2",
-	},
-	CCANItem{
-		Name:          "Clonk Rage Mac",
-		Date:          time.Date(2014, 5, 4, 23, 27, 0, 0, time.Local), // Last-Modified: Sun, 04 May 2014 23:27:00 GMT - time.Local is wrong but it's close enough i guess?
-		DownloadCount: 1,
-		Author:        "Redwolf Design",
-		Votes:         0,
-		Category:      "Engine",
-		Engine:        "CR",
-		DownloadLink:  "http://www.clonkx.de/rage/cr_full_mac.zip",
-	},
-
-	// Clonk 3 Radikal - US version
-	CCANItem{
-		Name:          "Clonk 3 Radikal US",
-		Date:          time.Date(1996, 0, 0, 0, 0, 0, 0, time.Local), // Published in 1996
-		DownloadCount: 1,
-		Author:        "Redwolf Design",
-		Votes:         0,
-		Category:      "Engine",
-		Engine:        "C3",
-		DownloadLink:  "http://www.clonkx.de/classics/clonk34us.zip",
-	},
-
-	// Clonk 4 - US version
-	CCANItem{
-		Name:          "Clonk US",                                    // The german Clonk 4 entry is called "Clonk.zip"
-		Date:          time.Date(1996, 0, 0, 0, 0, 0, 0, time.Local), // Published in 1996
-		DownloadCount: 1,
-		Author:        "Redwolf Design",
-		Votes:         0,
-		Category:      "Engine",
-		Engine:        "C4.25",
-		DownloadLink:  "http://www.clonkx.de/classics/clonk407us.zip",
-	},
+// Items that aren't listed on ccan.de are loaded from manifests. This includes Freeware keys, linux and mac versions and US versions (only german games are linked).
+// The default manifest is items.json, which is embedded into the program.
+
+// Manifest is a list of manually curated items
+type Manifest struct {
+	Items []ManifestItem `json:"items"`
+}
+
+// ManifestItem is an item in a manifest. Its fields are the same as the ones of CCANItem
+type ManifestItem struct {
+	Type          string `json:"type"`
+	Name          string `json:"name"`
+	Date          string `json:"date"` // Warning: dates of the default items are often estimates, e.g. the year it was published
+	DownloadCount int    `json:"download_count"`
+	Author        string `json:"author"`
+	Votes         int    `json:"votes"`
+	Category      string `json:"category"`
+	Engine        string `json:"engine"`
+	DownloadLink  string `json:"download_link"`
+	Size          int64  `json:"size"`
+	SHA256        string `json:"sha256"` // optional, downloads that don't match it are rejected
+
+	// Note explains where the item comes from, it is not part of the archived metadata
+	Note string `json:"note"`
+}
+
+// manifestDateFormats are tried in order when parsing ManifestItem.Date. Dates without time zone are in local time
+var manifestDateFormats = []string{
+	time.RFC3339,
+	"2006-01-02 15:04:05",
+	"2006-01-02",
+	"2006-01",
+	"2006",
+}
+
+func parseManifestDate(input string) (t time.Time, err error) {
+	for _, format := range manifestDateFormats {
+		if t, err = time.ParseInLocation(format, input, time.Local); err == nil {
+			return
+		}
+	}
+	return t, fmt.Errorf("unparsable date %q, expected a format like 2006-01-02", input)
+}
+
+// ManifestError describes an invalid item in a manifest
+type ManifestError struct {
+	Manifest string // name of the manifest, usually its path
+	Index    int    // index of the item in the manifest
+	Reason   string
+}
+
+func (m *ManifestError) Error() string {
+	return fmt.Sprintf("Invalid item %d in manifest %s: %s", m.Index, m.Manifest, m.Reason)
+}
+
+// ParseManifest reads and validates a manifest. `name` is used in errors.
+// If items are invalid, the returned error is an ErrorList of *ManifestError
+func ParseManifest(r io.Reader, name string) (items []CCANItem, err error) {
+	var m Manifest
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+	if err = dec.Decode(&m); err != nil {
+		return nil, fmt.Errorf("Error while reading manifest %s: %s", name, err.Error())
+	}
+
+	var errorlist ErrorList
+	for i, mi := range m.Items {
+		item, reason := mi.toItem()
+		if reason != "" {
+			errorlist = append(errorlist, &ManifestError{Manifest: name, Index: i, Reason: reason})
+			continue
+		}
+		items = append(items, item)
+	}
+
+	return items, errorlist.Err()
+}
+
+// toItem validates the manifest item and converts it. If it is invalid, the reason is returned
+func (mi ManifestItem) toItem() (item CCANItem, reason string) {
+	var missing []string
+	for _, field := range []struct{ name, value string }{
+		{"name", mi.Name},
+		{"date", mi.Date},
+		{"author", mi.Author},
+		{"category", mi.Category},
+		{"engine", mi.Engine},
+		{"download_link", mi.DownloadLink},
+	} {
+		if strings.TrimSpace(field.value) == "" {
+			missing = append(missing, field.name)
+		}
+	}
+	if len(missing) > 0 {
+		return item, "missing required fields " + strings.Join(missing, ", ")
+	}
+
+	date, err := parseManifestDate(mi.Date)
+	if err != nil {
+		return item, err.Error()
+	}
+
+	if mi.SHA256 != "" {
+		if sum, err := hex.DecodeString(mi.SHA256); err != nil || len(sum) != sha256.Size {
+			return item, fmt.Sprintf("invalid sha256 %q, expected %d hex digits", mi.SHA256, 2*sha256.Size)
+		}
+	}
+
+	return CCANItem{
+		Type:          mi.Type,
+		Name:          mi.Name,
+		Date:          date,
+		DownloadCount: mi.DownloadCount,
+		Author:        mi.Author,
+		Votes:         mi.Votes,
+		Category:      mi.Category,
+		Engine:        mi.Engine,
+		DownloadLink:  mi.DownloadLink,
+		Size:          mi.Size,
+		SHA256:        strings.ToLower(mi.SHA256),
+	}, ""
+}
+
+// DefaultManifest returns the items of the embedded default manifest
+func DefaultManifest() []CCANItem {
+	data, err := itemsJsonBytes()
+	if err != nil {
+		panic(err)
+	}
+
+	items, err := ParseManifest(strings.NewReader(string(data)), "items.json")
+	if err != nil {
+		panic(err) // The embedded manifest is checked by tests, so this should never happen
+	}
+	return items
+}
+
+// LoadManifests returns the items of the default manifest merged with the items of the manifest files at `paths`.
+// Download links must be unique across all manifests
+func LoadManifests(paths ...string) (items []CCANItem, err error) {
+	items = DefaultManifest()
+
+	var errorlist ErrorList
+	for _, path := range paths {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+
+		manifestItems, err := ParseManifest(f, path)
+		_ = f.Close()
+		if list, ok := err.(ErrorList); ok {
+			errorlist = append(errorlist, list...)
+		} else if err != nil {
+			return nil, err
+		}
+
+		items = append(items, manifestItems...)
+	}
+
+	var seen = make(map[string]bool)
+	for _, item := range items {
+		if seen[item.DownloadLink] {
+			errorlist = append(errorlist, fmt.Errorf("Download link %s is used by more than one manifest item", item.DownloadLink))
+		}
+		seen[item.DownloadLink] = true
+	}
+
+	if err = errorlist.Err(); err != nil {
+		return nil, err
+	}
+	return
 }
@@ -0,0 +1,67 @@
+package crawler
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDefaultManifest(t *testing.T) {
+	items, err := LoadManifests()
+	if err != nil {
+		t.Fatalf("embedded manifest is invalid: %s", err.Error())
+	}
+	if len(items) == 0 {
+		t.Fatalf("embedded manifest is empty")
+	}
+}
+
+func TestParseManifest(t *testing.T) {
+	items, err := ParseManifest(strings.NewReader(`{"items": [
+		{"name": "Valid", "date": "2001-02-03", "author": "A", "category": "C", "engine": "CE", "download_link": "http://example.com/a.zip"},
+		{"name": "No link", "date": "2001", "author": "A", "category": "C", "engine": "CE"},
+		{"name": "Bad date", "date": "03.02.2001", "author": "A", "category": "C", "engine": "CE", "download_link": "http://example.com/b.zip"},
+		{"name": "Bad checksum", "date": "2001", "author": "A", "category": "C", "engine": "CE", "download_link": "http://example.com/c.zip", "sha256": "abc"}
+	]}`), "test.json")
+
+	if len(items) != 1 || items[0].Date != time.Date(2001, 2, 3, 0, 0, 0, 0, time.Local) {
+		t.Errorf("expected only the valid item, got %+v", items)
+	}
+
+	errs := Errors(err)
+	if len(errs) != 3 {
+		t.Fatalf("expected 3 errors, got %v", errs)
+	}
+	if me, ok := errs[0].(*ManifestError); !ok || me.Index != 1 || !strings.Contains(me.Reason, "download_link") {
+		t.Errorf("unexpected error for missing link: %v", errs[0])
+	}
+	if me, ok := errs[1].(*ManifestError); !ok || me.Index != 2 || !strings.Contains(me.Reason, "date") {
+		t.Errorf("unexpected error for bad date: %v", errs[1])
+	}
+	if me, ok := errs[2].(*ManifestError); !ok || me.Index != 3 || !strings.Contains(me.Reason, "sha256") {
+		t.Errorf("unexpected error for bad checksum: %v", errs[2])
+	}
+}
+
+func TestLoadManifestsDuplicateLink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "manifest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "extra.json")
+	err = ioutil.WriteFile(path, []byte(`{"items": [
+		{"name": "Freeware again", "date": "2004", "author": "A", "category": "Key", "engine": "CE", "download_link": "http://www.clonkx.de/endeavour/Freeware.c4k"}
+	]}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = LoadManifests(path); err == nil || !strings.Contains(err.Error(), "Freeware.c4k") {
+		t.Errorf("expected error about duplicate link, got %v", err)
+	}
+}
@@ -0,0 +1,81 @@
+package crawler
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// HostLimiter limits the number of requests per second and the number of requests in flight for each host
+type HostLimiter struct {
+	// RequestsPerSecond is the maximum rate at which requests to a single host are started. 0 means no limit
+	RequestsPerSecond float64
+	// MaxInFlight is the maximum number of unfinished requests to a single host. 0 means no limit
+	MaxInFlight int
+
+	lock  sync.Mutex
+	hosts map[string]*hostState
+}
+
+type hostState struct {
+	next  time.Time     // the earliest time the next request may start
+	slots chan struct{} // holds a value for every request in flight
+}
+
+// NewHostLimiter returns a HostLimiter with the given limits
+func NewHostLimiter(requestsPerSecond float64, maxInFlight int) *HostLimiter {
+	return &HostLimiter{
+		RequestsPerSecond: requestsPerSecond,
+		MaxInFlight:       maxInFlight,
+	}
+}
+
+// Acquire waits until a request to host may be started. release must be called once the request is finished
+func (l *HostLimiter) Acquire(ctx context.Context, host string) (release func(), err error) {
+	l.lock.Lock()
+	if l.hosts == nil {
+		l.hosts = make(map[string]*hostState)
+	}
+	state, ok := l.hosts[host]
+	if !ok {
+		state = &hostState{}
+		if l.MaxInFlight > 0 {
+			state.slots = make(chan struct{}, l.MaxInFlight)
+		}
+		l.hosts[host] = state
+	}
+	l.lock.Unlock()
+
+	release = func() {}
+	if state.slots != nil {
+		select {
+		case state.slots <- struct{}{}:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+
+		var once sync.Once
+		release = func() {
+			once.Do(func() { <-state.slots })
+		}
+	}
+
+	if l.RequestsPerSecond > 0 {
+		// Reserve the next free start time, then wait for it
+		l.lock.Lock()
+		now := time.Now()
+		start := state.next
+		if start.Before(now) {
+			start = now
+		}
+		state.next = start.Add(time.Duration(float64(time.Second) / l.RequestsPerSecond))
+		l.lock.Unlock()
+
+		if err = sleep(ctx, time.Until(start)); err != nil {
+			release()
+			return nil, err
+		}
+	}
+
+	return release, nil
+}
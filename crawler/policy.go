@@ -0,0 +1,136 @@
+package crawler
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// PageFailureAction is what a crawler does once a listing page failed too often
+type PageFailureAction int
+
+const (
+	// AbortCrawl stops the crawl of the source, other sources are still crawled
+	AbortCrawl PageFailureAction = iota
+	// SkipPage continues with the next listing page
+	SkipPage
+)
+
+// ErrorPolicy decides how often a listing page is retried and what happens if it cannot be loaded
+type ErrorPolicy struct {
+	// Backoff contains the delays before each retry of a page, so a page is tried len(Backoff)+1 times
+	Backoff []time.Duration
+
+	// OnPageFailure is the action taken once all retries for a page failed
+	OnPageFailure PageFailureAction
+
+	// MaxConsecutiveFailures aborts the crawl after this many failed attempts in a row, regardless of the page.
+	// This prevents SkipPage from skipping through the whole listing if the site is down. 0 means no limit with AbortCrawl
+	// and DefaultSkippedPages pages with SkipPage, as there is no way to tell whether skipped pages are past the end of the listing
+	MaxConsecutiveFailures int
+}
+
+// DefaultSkippedPages is the number of pages in a row SkipPage skips before the crawl is aborted if MaxConsecutiveFailures is 0
+const DefaultSkippedPages = 3
+
+// maxConsecutiveFailures returns the limit of failed attempts in a row, 0 means no limit
+func (p ErrorPolicy) maxConsecutiveFailures() int {
+	if p.MaxConsecutiveFailures == 0 && p.OnPageFailure == SkipPage {
+		return DefaultSkippedPages * (len(p.Backoff) + 1)
+	}
+	return p.MaxConsecutiveFailures
+}
+
+// DefaultErrorPolicy tries every page six times, waiting five seconds in between, and aborts the crawl if a page still fails
+var DefaultErrorPolicy = ErrorPolicy{
+	Backoff:       []time.Duration{5 * time.Second, 5 * time.Second, 5 * time.Second, 5 * time.Second, 5 * time.Second},
+	OnPageFailure: AbortCrawl,
+}
+
+// ParsePageFailureAction parses "abort" or "skip"
+func ParsePageFailureAction(s string) (PageFailureAction, error) {
+	switch s {
+	case "abort":
+		return AbortCrawl, nil
+	case "skip":
+		return SkipPage, nil
+	}
+	return AbortCrawl, fmt.Errorf("unknown page failure action %q, expected \"abort\" or \"skip\"", s)
+}
+
+// ErrAborted matches all errors that caused a crawl to stop early, e.g. using errors.Is(err, ErrAborted)
+var ErrAborted = errors.New("crawl aborted")
+
+// PageError is returned by crawlers if a listing page could not be loaded, even after retrying it
+type PageError struct {
+	Page     int
+	Attempts int
+
+	// Aborted is set if the crawl of the source was stopped because of this error
+	Aborted bool
+
+	// Err is the error of the last attempt
+	Err error
+}
+
+func (p *PageError) Error() string {
+	msg := fmt.Sprintf("Error while loading listing page %d (%d attempts): %s", p.Page, p.Attempts, p.Err.Error())
+	if p.Aborted {
+		msg += " - crawl aborted"
+	}
+	return msg
+}
+
+func (p *PageError) Unwrap() error {
+	return p.Err
+}
+
+func (p *PageError) Is(target error) bool {
+	return target == ErrAborted && p.Aborted
+}
+
+// pageRetrier tracks the failed attempts to load a single page according to an ErrorPolicy
+type pageRetrier struct {
+	policy ErrorPolicy
+
+	attempts int
+}
+
+// failure records a failed attempt for page. If the page should be retried, it returns the delay to wait before that.
+// Otherwise a *PageError is returned, which tells whether the crawl should be aborted
+func (r *pageRetrier) failure(page int, err error) (retryAfter time.Duration, pageErr *PageError) {
+	r.attempts++
+	if r.attempts <= len(r.policy.Backoff) {
+		return r.policy.Backoff[r.attempts-1], nil
+	}
+
+	return 0, &PageError{
+		Page:     page,
+		Attempts: r.attempts,
+		Aborted:  r.policy.OnPageFailure == AbortCrawl,
+		Err:      err,
+	}
+}
+
+// failureStreak counts the failed attempts of the listing pages that failed in a row. It aborts the crawl once
+// there are more than the policy allows, so skipped pages after the last one that loaded cannot go on forever
+type failureStreak struct {
+	policy ErrorPolicy
+
+	failures int
+}
+
+// loaded ends the streak after a page was loaded
+func (s *failureStreak) loaded() {
+	s.failures = 0
+}
+
+// failed adds a page that could not be loaded and marks pageErr as aborted if the limit was reached.
+// It returns whether the crawl is aborted
+func (s *failureStreak) failed(pageErr *PageError) (aborted bool) {
+	s.failures += pageErr.Attempts
+	if max := s.policy.maxConsecutiveFailures(); max > 0 && s.failures >= max {
+		pageErr.Aborted = true
+	}
+	return pageErr.Aborted
+}
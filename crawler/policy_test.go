@@ -0,0 +1,74 @@
+package crawler
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestPageRetrier(t *testing.T) {
+	var errFetch = errors.New("fetch failed")
+
+	r := pageRetrier{policy: ErrorPolicy{
+		Backoff:       []time.Duration{time.Second, 2 * time.Second},
+		OnPageFailure: SkipPage,
+	}}
+
+	// The page fails three times and is skipped
+	for i, expected := range []time.Duration{time.Second, 2 * time.Second} {
+		delay, pageErr := r.failure(0, errFetch)
+		if pageErr != nil || delay != expected {
+			t.Fatalf("attempt %d: got delay %s and error %v, expected delay %s", i+1, delay, pageErr, expected)
+		}
+	}
+	_, pageErr := r.failure(0, errFetch)
+	if pageErr == nil || pageErr.Aborted || pageErr.Attempts != 3 {
+		t.Fatalf("expected page 0 to be skipped after 3 attempts, got %v", pageErr)
+	}
+	if !errors.Is(pageErr, errFetch) || errors.Is(pageErr, ErrAborted) {
+		t.Errorf("skipped page error should wrap the fetch error, but not ErrAborted")
+	}
+
+	r = pageRetrier{policy: ErrorPolicy{OnPageFailure: AbortCrawl}}
+	if _, pageErr = r.failure(0, errFetch); pageErr == nil || !errors.Is(pageErr, ErrAborted) {
+		t.Errorf("expected the crawl to be aborted without retries, got %v", pageErr)
+	}
+}
+
+func TestFailureStreak(t *testing.T) {
+	var (
+		errFetch = errors.New("fetch failed")
+		page     = func(attempts int) *PageError { return &PageError{Attempts: attempts, Err: errFetch} }
+	)
+
+	s := failureStreak{policy: ErrorPolicy{OnPageFailure: SkipPage, MaxConsecutiveFailures: 5}}
+	for _, attempts := range []int{3, 1} {
+		if s.failed(page(attempts)) {
+			t.Fatalf("aborted after %d failures", s.failures)
+		}
+	}
+	// A page that loads ends the streak
+	s.loaded()
+	for _, attempts := range []int{3, 1} {
+		s.failed(page(attempts))
+	}
+	if err := page(1); !s.failed(err) || !errors.Is(err, ErrAborted) {
+		t.Errorf("expected the crawl to be aborted after 5 failures in a row")
+	}
+
+	// Skipping has a limit even if none is set
+	s = failureStreak{policy: ErrorPolicy{OnPageFailure: SkipPage, Backoff: []time.Duration{0}}}
+	for i := 1; i <= DefaultSkippedPages; i++ {
+		if aborted := s.failed(page(2)); aborted != (i == DefaultSkippedPages) {
+			t.Errorf("page %d: aborted=%v", i, aborted)
+		}
+	}
+
+	// Without skipping, there is no limit
+	s = failureStreak{policy: ErrorPolicy{OnPageFailure: AbortCrawl}}
+	for i := 0; i < 100; i++ {
+		if s.failed(page(1)) {
+			t.Fatal("expected no limit")
+		}
+	}
+}
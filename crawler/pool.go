@@ -0,0 +1,72 @@
+package crawler
+
+import (
+	"context"
+	"sync"
+)
+
+// runOrdered calls work for the indexes start, start+1, ... with up to `workers` calls running at the same time.
+// The results are passed to emit in index order. No new work is started once emit returns false or ctx is done.
+// Calls that are still running at that point get a cancelled context and are awaited before runOrdered returns
+func runOrdered(ctx context.Context, workers, start int, work func(ctx context.Context, index int) interface{}, emit func(index int, result interface{}) bool) {
+	if workers < 1 {
+		workers = 1
+	}
+
+	var wg sync.WaitGroup
+	ctx, cancel := context.WithCancel(ctx)
+	defer wg.Wait()
+	defer cancel()
+
+	type job struct {
+		index  int
+		result chan interface{}
+	}
+
+	var (
+		running = make(chan struct{}, workers)
+		pending = make(chan job, workers)
+	)
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer close(pending)
+
+		for i := start; ; i++ {
+			select {
+			case running <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+
+			j := job{index: i, result: make(chan interface{}, 1)}
+			select {
+			case pending <- j:
+			case <-ctx.Done():
+				<-running
+				return
+			}
+
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				j.result <- work(ctx, j.index)
+				<-running
+			}()
+		}
+	}()
+
+	for j := range pending {
+		var result interface{}
+		select {
+		case result = <-j.result:
+		case <-ctx.Done():
+			return
+		}
+
+		if !emit(j.index, result) {
+			return
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package crawler
+
+import (
+	"context"
+	"math/rand"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRunOrdered(t *testing.T) {
+	var running, maxRunning int32
+	var emitted []int
+
+	runOrdered(context.Background(), 3, 5, func(ctx context.Context, index int) interface{} {
+		n := atomic.AddInt32(&running, 1)
+		for {
+			m := atomic.LoadInt32(&maxRunning)
+			if n <= m || atomic.CompareAndSwapInt32(&maxRunning, m, n) {
+				break
+			}
+		}
+		time.Sleep(time.Duration(rand.Intn(5)) * time.Millisecond)
+		atomic.AddInt32(&running, -1)
+		return index * 2
+	}, func(index int, result interface{}) bool {
+		if result.(int) != index*2 {
+			t.Errorf("got result %v for index %d", result, index)
+		}
+		emitted = append(emitted, index)
+		return index < 20
+	})
+
+	if len(emitted) != 16 {
+		t.Fatalf("expected indexes 5 to 20, got %v", emitted)
+	}
+	for i, index := range emitted {
+		if index != i+5 {
+			t.Fatalf("results are not in order: %v", emitted)
+		}
+	}
+	if maxRunning > 3 {
+		t.Errorf("%d calls were running at the same time, expected at most 3", maxRunning)
+	}
+}
+
+func TestHostLimiter(t *testing.T) {
+	l := NewHostLimiter(20, 1)
+	ctx := context.Background()
+
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		release, err := l.Acquire(ctx, "example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		release()
+	}
+	// The first request starts immediately, the others 50ms after the previous one
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Errorf("3 requests at 20 per second took only %s", elapsed)
+	}
+
+	// Other hosts are not affected
+	release, err := l.Acquire(ctx, "example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+
+	// The only slot for example.org is taken, so this has to wait until ctx is done
+	timeoutCtx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	if _, err = l.Acquire(timeoutCtx, "example.org"); err == nil {
+		t.Errorf("expected Acquire to fail while the only slot is taken")
+	}
+}
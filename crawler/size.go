@@ -0,0 +1,54 @@
+package crawler
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// fileSizeRe also allows non-breaking spaces between number and unit, as HTML pages often use &nbsp; there
+var fileSizeRe = regexp.MustCompile(`^([\d.,]+)[\s\x{00A0}]*([a-zA-Z]*)$`)
+
+var fileSizeUnits = map[string]float64{
+	"":      1,
+	"b":     1,
+	"byte":  1,
+	"bytes": 1,
+	"k":     1 << 10,
+	"kb":    1 << 10,
+	"kib":   1 << 10,
+	"m":     1 << 20,
+	"mb":    1 << 20,
+	"mib":   1 << 20,
+	"g":     1 << 30,
+	"gb":    1 << 30,
+	"gib":   1 << 30,
+}
+
+// parseFileSize parses sizes like "1,2 MB", "1.5 KB" or "512 Bytes" and returns them in bytes.
+// Both German and English decimal separators are supported; units are binary (1 KB = 1024 bytes)
+func parseFileSize(input string) (int64, error) {
+	matches := fileSizeRe.FindStringSubmatch(strings.TrimSpace(input))
+	if matches == nil {
+		return 0, fmt.Errorf("invalid file size %q", input)
+	}
+
+	unit, ok := fileSizeUnits[strings.ToLower(matches[2])]
+	if !ok {
+		return 0, fmt.Errorf("unknown unit in file size %q", input)
+	}
+
+	number := matches[1]
+	if strings.Contains(number, ",") {
+		// German format: "1.234,5"
+		number = strings.Replace(strings.Replace(number, ".", "", -1), ",", ".", -1)
+	}
+
+	value, err := strconv.ParseFloat(number, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid file size %q: %s", input, err.Error())
+	}
+
+	return int64(value*unit + 0.5), nil
+}
@@ -0,0 +1,32 @@
+package crawler
+
+import "testing"
+
+func TestParseFileSize(t *testing.T) {
+	table := map[string]int64{
+		"512 Bytes":   512,
+		"10 KB":       10240,
+		"1,5 MB":      1572864,
+		"1.5 MB":      1572864,
+		"1.024,0 K":   1048576,
+		"2GB":         2147483648,
+		"1,2\u00a0MB": 1258291,
+	}
+
+	for key, value := range table {
+		res, err := parseFileSize(key)
+		if err != nil {
+			t.Errorf("`%s`: %s", key, err.Error())
+			continue
+		}
+		if res != value {
+			t.Errorf("`%s`=`%d`, expected `%d`", key, res, value)
+		}
+	}
+
+	for _, invalid := range []string{"", "MB", "1 parsec"} {
+		if _, err := parseFileSize(invalid); err == nil {
+			t.Errorf("expected error for `%s`", invalid)
+		}
+	}
+}
@@ -0,0 +1,196 @@
+package crawler
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/xarantolus/ccan-archiver/zipfactory"
+)
+
+// Source is a site that can be crawled for downloadable items
+type Source interface {
+	// Name is the short, unique name used to enable or disable this source
+	Name() string
+	// Description describes the source for humans, e.g. the site it crawls
+	Description() string
+	// Crawl sends all items of this source to output - it must not close the channel.
+	// The returned error might be an ErrorList if there were multiple non-fatal errors
+	Crawl(ctx context.Context, output chan<- zipfactory.Archivable) error
+}
+
+// Options contains settings that are passed to all sources that implement Configurable
+type Options struct {
+	// Fetcher is used for all requests. Its Limiter decides how polite sources are to each host
+	Fetcher *Fetcher
+
+	// Workers is the maximum number of pages a source loads at the same time
+	Workers int
+
+	// ErrorPolicy decides what happens if a listing page cannot be loaded
+	ErrorPolicy ErrorPolicy
+
+	// AdditionalItems are archived together with the CCAN items, see LoadManifests
+	AdditionalItems []CCANItem
+
+	// ClonkCenter configures how items of the Clonk-Center archive are discovered
+	ClonkCenter ClonkCenterOptions
+
+	// Journal records crawled listing pages. If it is nil, nothing is recorded
+	Journal PageJournal
+
+	// CCANStopBefore ends the CCAN crawl after the first listing page that contains an item uploaded before it.
+	// As the listing is sorted by date, all items after that are older. The zero value crawls the entire listing
+	CCANStopBefore time.Time
+}
+
+// PageJournal remembers listing pages of earlier runs, so pages whose items have all been archived don't need to be crawled again.
+// It is implemented by *zipfactory.Journal
+type PageJournal interface {
+	// PageCrawled is called with the download links of all items on a page
+	PageCrawled(source string, page int, links []string)
+	// PageDone returns whether the page was crawled in an earlier run and all of its items have been archived
+	PageDone(source string, page int) bool
+}
+
+// DefaultOptions returns the options sources use if Configure is never called
+func DefaultOptions() Options {
+	return Options{
+		Fetcher:         DefaultFetcher,
+		Workers:         4,
+		ErrorPolicy:     DefaultErrorPolicy,
+		AdditionalItems: DefaultManifest(),
+		ClonkCenter:     DefaultClonkCenterOptions,
+	}
+}
+
+// Configurable is implemented by sources that can be configured using Options
+type Configurable interface {
+	Configure(opts Options)
+}
+
+// Configure passes opts to all registered sources that implement Configurable
+func Configure(opts Options) {
+	for _, name := range registryOrder {
+		if c, ok := registry[name].(Configurable); ok {
+			c.Configure(opts)
+		}
+	}
+}
+
+// ErrorList collects errors that didn't stop a crawl
+type ErrorList []error
+
+func (e ErrorList) Error() string {
+	var msgs = make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "\n")
+}
+
+// Err returns nil if the list is empty, else the list itself
+func (e ErrorList) Err() error {
+	if len(e) == 0 {
+		return nil
+	}
+	return e
+}
+
+// Errors unpacks err into all errors it contains
+func Errors(err error) []error {
+	if err == nil {
+		return nil
+	}
+	if list, ok := err.(ErrorList); ok {
+		return list
+	}
+	return []error{err}
+}
+
+var (
+	registry      = make(map[string]Source)
+	registryOrder []string
+)
+
+func init() {
+	// The order matters: items are archived in the order they are crawled
+	Register(&ccanSource{opts: DefaultOptions()})
+	Register(&clonkCenterSource{opts: DefaultOptions()})
+}
+
+// Register adds a source to the registry. Sources are crawled in the order they were registered.
+// It panics if a source with the same name was already registered
+func Register(s Source) {
+	name := s.Name()
+	if _, exists := registry[name]; exists {
+		panic(fmt.Sprintf("crawler: source %q registered twice", name))
+	}
+	registry[name] = s
+	registryOrder = append(registryOrder, name)
+}
+
+// Lookup returns the source with the given name
+func Lookup(name string) (s Source, ok bool) {
+	s, ok = registry[name]
+	return
+}
+
+// Sources returns all registered sources in registration order
+func Sources() (sources []Source) {
+	for _, name := range registryOrder {
+		sources = append(sources, registry[name])
+	}
+	return
+}
+
+// Select returns the registered sources that should be crawled. If `enabled` is empty, all sources are enabled.
+// Sources named in `disabled` are never returned. Unknown names result in an error
+func Select(enabled, disabled []string) (sources []Source, err error) {
+	for _, name := range append(append([]string{}, enabled...), disabled...) {
+		if _, ok := registry[name]; !ok {
+			return nil, fmt.Errorf("unknown source %q", name)
+		}
+	}
+
+	var isEnabled = make(map[string]bool)
+	for _, name := range enabled {
+		isEnabled[name] = true
+	}
+	var isDisabled = make(map[string]bool)
+	for _, name := range disabled {
+		isDisabled[name] = true
+	}
+
+	for _, name := range registryOrder {
+		if isDisabled[name] || (len(enabled) > 0 && !isEnabled[name]) {
+			continue
+		}
+		sources = append(sources, registry[name])
+	}
+	return
+}
+
+// sendItem sends item to output, except if ctx is done before the item could be sent
+func sendItem(ctx context.Context, output chan<- zipfactory.Archivable, item zipfactory.Archivable) error {
+	select {
+	case output <- item:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// sleep pauses for the duration d or until ctx is done
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,35 @@
+package crawler
+
+import "testing"
+
+func TestSelect(t *testing.T) {
+	table := []struct {
+		enabled, disabled []string
+		expected          []string
+	}{
+		{nil, nil, []string{"ccan", "clonk-center"}},
+		{[]string{"clonk-center"}, nil, []string{"clonk-center"}},
+		{nil, []string{"ccan"}, []string{"clonk-center"}},
+		{[]string{"ccan"}, []string{"ccan"}, nil},
+	}
+
+	for _, entry := range table {
+		sources, err := Select(entry.enabled, entry.disabled)
+		if err != nil {
+			t.Fatalf("Select(%v, %v): %s", entry.enabled, entry.disabled, err.Error())
+		}
+
+		if len(sources) != len(entry.expected) {
+			t.Fatalf("Select(%v, %v) returned %d sources, expected %v", entry.enabled, entry.disabled, len(sources), entry.expected)
+		}
+		for i, src := range sources {
+			if src.Name() != entry.expected[i] {
+				t.Errorf("Select(%v, %v)[%d]=`%s`, expected `%s`", entry.enabled, entry.disabled, i, src.Name(), entry.expected[i])
+			}
+		}
+	}
+
+	if _, err := Select([]string{"does-not-exist"}, nil); err == nil {
+		t.Errorf("expected error for unknown source")
+	}
+}
@@ -0,0 +1,322 @@
+package crawler
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base32"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// warcDrainLimit is how much of a response body that was closed early, e.g. an error page, is read to record it
+const warcDrainLimit = 1 << 20
+
+// WARCWriter records HTTP requests and responses in a WARC 1.1 file, so a crawl can be replayed in web archive tools.
+// If the file name ends in .gz, every record is compressed on its own, as is usual for WARC files.
+//
+// Responses that were decompressed transparently by the http package are recorded decompressed, without Content-Encoding
+type WARCWriter struct {
+	// TempDir is where response bodies are stored until they have been read completely.
+	// If it is empty, the default directory for temporary files is used
+	TempDir string
+
+	lock     sync.Mutex
+	f        *os.File
+	compress bool
+	err      error // first error while writing, no records are written after it
+}
+
+// warcRecord is a record that has not been written yet. Content-Length is added when writing it
+type warcRecord struct {
+	fields [][2]string
+	block  io.Reader
+	length int64
+}
+
+// CreateWARC creates a WARC file at path, overwriting an existing one
+func CreateWARC(path string) (*WARCWriter, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	w := &WARCWriter{f: f, compress: strings.HasSuffix(path, ".gz")}
+
+	info := "software: ccan-archiver\r\n" +
+		"format: WARC File Format 1.1\r\n" +
+		"conformsTo: http://iipc.github.io/warc-specifications/specifications/warc-format/warc-1.1/\r\n"
+	err = w.write(warcRecord{
+		fields: [][2]string{
+			{"WARC-Type", "warcinfo"},
+			{"WARC-Record-ID", newRecordID()},
+			{"WARC-Date", warcDate(time.Now())},
+			{"WARC-Filename", filepath.Base(path)},
+			{"Content-Type", "application/warc-fields"},
+		},
+		block:  strings.NewReader(info),
+		length: int64(len(info)),
+	})
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return w, nil
+}
+
+// Transport returns an http.RoundTripper that sends requests using next and records them with their responses.
+// If next is nil, http.DefaultTransport is used. Every redirect is recorded as its own exchange.
+// An exchange is written once the response body has been closed
+func (w *WARCWriter) Transport(next http.RoundTripper) http.RoundTripper {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	return warcTransport{w: w, next: next}
+}
+
+// Close closes the WARC file. It returns the first error that happened while writing
+func (w *WARCWriter) Close() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	err := w.f.Close()
+	if w.err != nil {
+		return w.err
+	}
+	return err
+}
+
+// write appends the records to the file, one directly after another
+func (w *WARCWriter) write(records ...warcRecord) error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if w.err != nil {
+		return w.err
+	}
+
+	for _, record := range records {
+		var (
+			out io.Writer = w.f
+			gz  *gzip.Writer
+		)
+		if w.compress {
+			gz = gzip.NewWriter(w.f)
+			out = gz
+		}
+
+		bw := bufio.NewWriter(out)
+		bw.WriteString("WARC/1.1\r\n")
+		for _, field := range record.fields {
+			fmt.Fprintf(bw, "%s: %s\r\n", field[0], field[1])
+		}
+		fmt.Fprintf(bw, "Content-Length: %d\r\n\r\n", record.length)
+
+		_, err := io.CopyN(bw, record.block, record.length)
+		if err == nil {
+			_, err = bw.WriteString("\r\n\r\n")
+		}
+		if err == nil {
+			err = bw.Flush()
+		}
+		if err == nil && gz != nil {
+			err = gz.Close()
+		}
+		if err != nil {
+			w.err = fmt.Errorf("while writing WARC file: %w", err)
+			return w.err
+		}
+	}
+	return nil
+}
+
+// fail records err unless there already was an error
+func (w *WARCWriter) fail(err error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if w.err == nil {
+		w.err = err
+	}
+}
+
+type warcTransport struct {
+	w    *WARCWriter
+	next http.RoundTripper
+}
+
+// RoundTrip implements http.RoundTripper
+func (t warcTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	date := time.Now()
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		return resp, err
+	}
+
+	spool, err := ioutil.TempFile(t.w.TempDir, "warc-*")
+	if err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+
+	// WARC readers expect HTTP/1.x messages, so responses sent using HTTP/2 are recorded like that too
+	var head bytes.Buffer
+	fmt.Fprintf(&head, "HTTP/1.1 %03d %s\r\n", resp.StatusCode, http.StatusText(resp.StatusCode))
+	resp.Header.Write(&head)
+	head.WriteString("\r\n")
+
+	body := &warcBody{
+		ReadCloser: resp.Body,
+		w:          t.w,
+		req:        req,
+		date:       date,
+		head:       head.Bytes(),
+		spool:      spool,
+		payload:    sha1.New(),
+		block:      sha1.New(),
+	}
+	body.block.Write(body.head)
+	resp.Body = body
+
+	return resp, nil
+}
+
+// warcBody copies a response body to a temporary file while it is read. The exchange is recorded when it is closed
+type warcBody struct {
+	io.ReadCloser
+
+	w    *WARCWriter
+	req  *http.Request
+	date time.Time
+	head []byte
+
+	spool          *os.File
+	spoolErr       error
+	payload, block hash.Hash
+	size           int64
+
+	eof, closed bool
+}
+
+func (b *warcBody) Read(p []byte) (n int, err error) {
+	n, err = b.ReadCloser.Read(p)
+	if n > 0 {
+		if _, werr := b.spool.Write(p[:n]); werr != nil && b.spoolErr == nil {
+			b.spoolErr = werr
+		}
+		b.payload.Write(p[:n])
+		b.block.Write(p[:n])
+		b.size += int64(n)
+	}
+	if err == io.EOF {
+		b.eof = true
+	}
+	return
+}
+
+// Close records the exchange. Bodies that weren't read completely are read up to warcDrainLimit first,
+// if they are longer, the record is marked as truncated
+func (b *warcBody) Close() error {
+	if b.closed {
+		return nil
+	}
+	b.closed = true
+
+	if !b.eof {
+		_, _ = io.CopyN(ioutil.Discard, b, warcDrainLimit)
+	}
+	err := b.ReadCloser.Close()
+
+	// Errors are reported by WARCWriter.Close, the response itself is fine
+	if rerr := b.record(); rerr != nil {
+		b.w.fail(fmt.Errorf("while recording %s: %w", b.req.URL.String(), rerr))
+	}
+	b.spool.Close()
+	os.Remove(b.spool.Name())
+
+	return err
+}
+
+func (b *warcBody) record() error {
+	if b.spoolErr != nil {
+		return b.spoolErr
+	}
+	if _, err := b.spool.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	var (
+		responseID = newRecordID()
+		date       = warcDate(b.date)
+		uri        = b.req.URL.String()
+	)
+
+	response := warcRecord{
+		fields: [][2]string{
+			{"WARC-Type", "response"},
+			{"WARC-Record-ID", responseID},
+			{"WARC-Date", date},
+			{"WARC-Target-URI", uri},
+			{"Content-Type", "application/http;msgtype=response"},
+			{"WARC-Payload-Digest", warcDigest(b.payload)},
+			{"WARC-Block-Digest", warcDigest(b.block)},
+		},
+		block:  io.MultiReader(bytes.NewReader(b.head), b.spool),
+		length: int64(len(b.head)) + b.size,
+	}
+	if !b.eof {
+		response.fields = append(response.fields, [2]string{"WARC-Truncated", "unspecified"})
+	}
+
+	var req bytes.Buffer
+	fmt.Fprintf(&req, "%s %s HTTP/1.1\r\nHost: %s\r\n", b.req.Method, b.req.URL.RequestURI(), b.req.URL.Host)
+	b.req.Header.Write(&req)
+	req.WriteString("\r\n")
+	reqDigest := sha1.New()
+	reqDigest.Write(req.Bytes())
+
+	request := warcRecord{
+		fields: [][2]string{
+			{"WARC-Type", "request"},
+			{"WARC-Record-ID", newRecordID()},
+			{"WARC-Date", date},
+			{"WARC-Target-URI", uri},
+			{"WARC-Concurrent-To", responseID},
+			{"Content-Type", "application/http;msgtype=request"},
+			{"WARC-Block-Digest", warcDigest(reqDigest)},
+		},
+		block:  &req,
+		length: int64(req.Len()),
+	}
+
+	return b.w.write(response, request)
+}
+
+// newRecordID returns a random UUID as WARC-Record-ID
+func newRecordID() string {
+	var u [16]byte
+	if _, err := rand.Read(u[:]); err != nil {
+		panic(err) // This should never happen
+	}
+	u[6] = u[6]&0x0f | 0x40 // Version 4
+	u[8] = u[8]&0x3f | 0x80 // Variant RFC 4122
+	return fmt.Sprintf("<urn:uuid:%x-%x-%x-%x-%x>", u[0:4], u[4:6], u[6:8], u[8:10], u[10:])
+}
+
+func warcDate(t time.Time) string {
+	return t.UTC().Format("2006-01-02T15:04:05Z")
+}
+
+// warcDigest formats a SHA-1 digest like most WARC tools do
+func warcDigest(h hash.Hash) string {
+	return "sha1:" + base32.StdEncoding.EncodeToString(h.Sum(nil))
+}
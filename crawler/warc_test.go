@@ -0,0 +1,145 @@
+package crawler
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"crypto/sha1"
+	"encoding/base32"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// readWARC returns the header fields and block of all records in a WARC file
+func readWARC(t *testing.T, path string) (headers []map[string]string, blocks []string) {
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	if strings.HasSuffix(path, ".gz") {
+		if r, err = gzip.NewReader(f); err != nil {
+			t.Fatal(err)
+		}
+	}
+	br := bufio.NewReader(r)
+
+	for {
+		version, err := br.ReadString('\n')
+		if err == io.EOF {
+			return
+		}
+		if version != "WARC/1.1\r\n" {
+			t.Fatalf("expected a record, got %q", version)
+		}
+
+		var header = make(map[string]string)
+		for {
+			line, err := br.ReadString('\n')
+			if err != nil {
+				t.Fatal(err)
+			}
+			if line == "\r\n" {
+				break
+			}
+			parts := strings.SplitN(strings.TrimSuffix(line, "\r\n"), ": ", 2)
+			header[parts[0]] = parts[1]
+		}
+
+		length, _ := strconv.Atoi(header["Content-Length"])
+		var block = make([]byte, length+4)
+		if _, err = io.ReadFull(br, block); err != nil || string(block[length:]) != "\r\n\r\n" {
+			t.Fatalf("record %s is not terminated correctly", header["WARC-Record-ID"])
+		}
+		headers = append(headers, header)
+		blocks = append(blocks, string(block[:length]))
+	}
+}
+
+func TestWARC(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/redirect":
+			http.Redirect(w, r, "/file.c4d", http.StatusFound)
+		case "/file.c4d":
+			w.Write([]byte("file content"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "warc-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, name := range []string{"test.warc", "test.warc.gz"} {
+		path := filepath.Join(dir, name)
+		warc, err := CreateWARC(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		f := NewFetcher()
+		f.MaxRetries = 0
+		f.Client = &http.Client{Transport: warc.Transport(nil)}
+
+		content, err := f.Open(context.Background(), srv.URL+"/redirect")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ioutil.ReadAll(content)
+		content.Close()
+		if _, err = f.Get(context.Background(), srv.URL+"/missing"); err == nil {
+			t.Fatal("expected an error for a missing page")
+		}
+
+		if err = warc.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		headers, blocks := readWARC(t, path)
+		var types []string
+		for _, h := range headers {
+			types = append(types, h["WARC-Type"])
+		}
+		if strings.Join(types, ",") != "warcinfo,response,request,response,request,response,request" {
+			t.Fatalf("%s: unexpected records %v", name, types)
+		}
+
+		// The redirect, the file and the error page are all recorded
+		for i, expected := range map[int]string{1: "HTTP/1.1 302 Found", 3: "HTTP/1.1 200 OK", 5: "HTTP/1.1 404 Not Found"} {
+			if !strings.HasPrefix(blocks[i], expected) {
+				t.Errorf("%s: expected record %d to start with %q, got %q", name, i, expected, blocks[i])
+			}
+			if headers[i+1]["WARC-Concurrent-To"] != headers[i]["WARC-Record-ID"] {
+				t.Errorf("%s: request %d doesn't refer to its response", name, i+1)
+			}
+			if headers[i+1]["WARC-Target-URI"] != headers[i]["WARC-Target-URI"] {
+				t.Errorf("%s: request %d has a different URI than its response", name, i+1)
+			}
+		}
+
+		sum := sha1.Sum([]byte("file content"))
+		if digest := "sha1:" + base32.StdEncoding.EncodeToString(sum[:]); headers[3]["WARC-Payload-Digest"] != digest {
+			t.Errorf("%s: expected payload digest %s, got %s", name, digest, headers[3]["WARC-Payload-Digest"])
+		}
+		if !strings.HasSuffix(blocks[3], "\r\n\r\nfile content") || headers[3]["WARC-Target-URI"] != srv.URL+"/file.c4d" {
+			t.Errorf("%s: the file was not recorded correctly: %q", name, blocks[3])
+		}
+		if !strings.HasPrefix(headers[0]["WARC-Record-ID"], "<urn:uuid:") || headers[0]["WARC-Record-ID"] == headers[1]["WARC-Record-ID"] {
+			t.Errorf("%s: invalid record ids", name)
+		}
+	}
+}
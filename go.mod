@@ -1,9 +1,11 @@
 module github.com/xarantolus/ccan-archiver
 
-go 1.13
+go 1.17
 
 require (
 	github.com/PuerkitoBio/goquery v1.5.0
 	github.com/iorlas/whitefriday v0.0.0-20170216131615-0d890f726eed
 	golang.org/x/net v0.0.0-20191028085509-fe3aa8a45271
 )
+
+require github.com/andybalholm/cascadia v1.0.0 // indirect
@@ -1,38 +1,343 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
 	"log"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
 
+	"github.com/xarantolus/ccan-archiver/catalog"
 	"github.com/xarantolus/ccan-archiver/crawler"
+	"github.com/xarantolus/ccan-archiver/update"
 	"github.com/xarantolus/ccan-archiver/zipfactory"
 )
 
 func main() {
+	var (
+		enabledSources  = flag.String("sources", "", "Comma-separated list of sources to crawl (default: all sources)")
+		disabledSources = flag.String("skip", "", "Comma-separated list of sources that should not be crawled")
+		listSources     = flag.Bool("list-sources", false, "List all available sources and exit")
+		manifests       = flag.String("manifest", "", "Comma-separated list of manifest files with items that should be archived in addition to the built-in ones")
+		catalogOnly     = flag.Bool("catalog", false, "Only write a catalog of all items as JSON Lines and CSV instead of downloading them")
+		format          = flag.String("format", "zip", "Format of the archive: zip, dir (a directory tree), tar, tar.gz, tar.zst (needs the zstd command) or none (with -warc)")
+		outputPath      = flag.String("output", "", "Where the archive is written, \"-\" writes tar streams to the standard output. A text/template with {{.Date}}, {{.Time}} (HH-MM-SS), {{.Format}} and {{.Ext}} (default: \""+zipfactory.DefaultOutput+"\")")
+		layout          = flag.String("layout", zipfactory.DefaultLayout, "text/template for the path of every item in the archive without extension, e.g. \"{{.Engine}}/{{.Category}}/{{.Author}}/{{.Name}}\"; see README.md for all fields")
+		resume          = flag.String("resume", "", "Continue an interrupted run that was writing to this archive, using the journal next to it")
+		updateFrom      = flag.String("update", "", "Only download items that are new or changed since this earlier archive and copy all others from it")
+		delta           = flag.Bool("delta", false, "With -update, only put new and changed items into the archive")
+
+		backoff       = flag.String("backoff", "5s,5s,5s,5s,5s", "Comma-separated delays before retrying a failed listing page; a page is tried once more than the number of delays")
+		onPageFailure = flag.String("on-page-failure", "abort", "What to do if a listing page cannot be loaded: \"abort\" the source or \"skip\" the page")
+		maxFailures   = flag.Int("max-failures", 0, "Abort a source after this many failed listing requests in a row, 0 means no limit with -on-page-failure abort and three skipped pages with skip")
+
+		userAgent       = flag.String("user-agent", crawler.DefaultUserAgent, "User-Agent header sent with all requests")
+		timeout         = flag.Duration("timeout", 2*time.Minute, "Timeout for loading a single page")
+		downloadTimeout = flag.Duration("download-timeout", 30*time.Minute, "Timeout for downloading a single file")
+		retries         = flag.Int("retries", 3, "How often requests are retried on network errors and server errors")
+
+		workers     = flag.Int("workers", 4, "Number of pages each source loads at the same time")
+		rps         = flag.Float64("rps", 4, "Maximum number of requests per second to a single host, 0 means no limit")
+		maxInFlight = flag.Int("max-in-flight", 4, "Maximum number of requests to a single host at the same time, 0 means no limit")
+		downloads   = flag.Int("downloads", 4, "Number of files that are downloaded at the same time")
+		spoolBudget = flag.Int64("spool-budget", 2048, "Disk space in MiB that downloaded files waiting to be written to the archive may take up, 0 means no limit")
+		spoolDir    = flag.String("spool-dir", "", "Directory for downloaded files that wait to be written to the archive (default: the system directory for temporary files)")
+		dedup       = flag.Bool("dedup", true, "Store files with the same content only once, even if they belong to items of different sources")
+
+		ccLastID     = flag.Int("cc-last-id", crawler.DefaultClonkCenterOptions.LastKnownID, "Highest Clonk-Center item id that is known to exist")
+		ccMaxMissing = flag.Int("cc-max-missing", crawler.DefaultClonkCenterOptions.MaxMissing, "Stop probing Clonk-Center ids after this many ids in a row after the highest known id don't exist")
+		ccSeedURLs   = flag.String("cc-seed", "", "Comma-separated list of Clonk-Center pages whose links to items are used to find item ids")
+
+		recordDir = flag.String("record", "", "Record all responses of the crawlers to this directory")
+		replayDir = flag.String("replay", "", "Replay responses for the crawlers from a directory created with -record instead of accessing the sites")
+		warcPath  = flag.String("warc", "", "Record all requests and responses of the crawlers and downloads in this WARC file, compressed if its name ends in .gz")
+	)
+	flag.Parse()
+
+	if *listSources {
+		for _, src := range crawler.Sources() {
+			fmt.Printf("%-15s %s\n", src.Name(), src.Description())
+		}
+		return
+	}
+
+	sources, err := crawler.Select(splitList(*enabledSources), splitList(*disabledSources))
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	var fetcher = crawler.NewFetcher()
+	fetcher.UserAgent = *userAgent
+	fetcher.Timeout = *timeout
+	fetcher.MaxRetries = *retries
+	fetcher.Limiter = crawler.NewHostLimiter(*rps, *maxInFlight)
+
+	// Downloads share connections with the crawlers, but can take a lot longer
+	var downloader = *fetcher
+	downloader.Timeout = *downloadTimeout
+
+	// Only the crawlers use cassettes, downloads would make them way too big
+	if *recordDir != "" || *replayDir != "" {
+		var cassette = &crawler.Cassette{Dir: *recordDir, Mode: crawler.Record, Transport: fetcher.Client.Transport}
+		if *replayDir != "" {
+			cassette = &crawler.Cassette{Dir: *replayDir, Mode: crawler.Replay}
+		}
+
+		var client = *fetcher.Client
+		client.Transport = cassette
+		fetcher.Client = &client
+	}
+
+	// The WARC file gets every exchange, including replayed ones
+	var warc *crawler.WARCWriter
+	if *warcPath != "" {
+		if warc, err = crawler.CreateWARC(*warcPath); err != nil {
+			log.Fatalln(err)
+		}
+		warc.TempDir = *spoolDir
+		defer func() {
+			if err := warc.Close(); err != nil {
+				log.Println(err)
+			}
+		}()
+
+		for _, f := range []*crawler.Fetcher{fetcher, &downloader} {
+			var client = *f.Client
+			client.Transport = warc.Transport(client.Transport)
+			f.Client = &client
+		}
+	}
+
+	var opts = crawler.DefaultOptions()
+	opts.Fetcher = fetcher
+	opts.Workers = *workers
+	if opts.AdditionalItems, err = crawler.LoadManifests(splitList(*manifests)...); err != nil {
+		log.Fatalln(err)
+	}
+	opts.ErrorPolicy.Backoff = nil
+	for _, d := range splitList(*backoff) {
+		delay, err := time.ParseDuration(d)
+		if err != nil {
+			log.Fatalln("invalid backoff:", err)
+		}
+		opts.ErrorPolicy.Backoff = append(opts.ErrorPolicy.Backoff, delay)
+	}
+	if opts.ErrorPolicy.OnPageFailure, err = crawler.ParsePageFailureAction(*onPageFailure); err != nil {
+		log.Fatalln(err)
+	}
+	opts.ErrorPolicy.MaxConsecutiveFailures = *maxFailures
+	opts.ClonkCenter.LastKnownID = *ccLastID
+	opts.ClonkCenter.MaxMissing = *ccMaxMissing
+	opts.ClonkCenter.SeedURLs = splitList(*ccSeedURLs)
+
+	archiveFormat, err := zipfactory.ParseFormat(*format)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if archiveFormat == zipfactory.FormatNone && *warcPath == "" {
+		log.Fatalln("-format none only makes sense with -warc")
+	}
+	if *resume != "" && (*outputPath != "" || !archiveFormat.Resumable()) {
+		log.Fatalln("-resume cannot be combined with -output, and only zip archives and directories can be resumed")
+	}
+
+	itemLayout, err := zipfactory.ParseLayout(*layout)
+	if err != nil {
+		log.Fatalln("invalid -layout:", err)
+	}
+
+	var (
+		archivePath = zipfactory.FormatFilename(archiveFormat)
+		journal     *zipfactory.Journal
+		previous    *update.Previous
+	)
+	if *outputPath != "" {
+		if archivePath, err = zipfactory.OutputPath(*outputPath, archiveFormat); err != nil {
+			log.Fatalln("invalid -output:", err)
+		}
+	}
+	if *resume != "" {
+		archivePath = *resume
+	}
+	if *updateFrom != "" {
+		if *catalogOnly || *resume != "" {
+			log.Fatalln("-update cannot be combined with -catalog or -resume")
+		}
+		if previous, err = update.Open(*updateFrom); err != nil {
+			log.Fatalln(err)
+		}
+		defer previous.Close()
+		fmt.Printf("Updating %s with %d items\n", *updateFrom, previous.Len())
+
+		// CCAN is sorted by date, so everything older than the newest item we have is known already
+		opts.CCANStopBefore = previous.NewestCCAN()
+		if *delta && *outputPath == "" {
+			archivePath = update.DeltaFilename(archiveFormat)
+		}
+	}
+
+	// The sink is opened first, as it creates the folder the journal is put into
+	var sink zipfactory.Sink
+	if !*catalogOnly {
+		if sink, err = zipfactory.OpenSink(archiveFormat, archivePath, *resume != ""); err != nil {
+			log.Fatalln(err)
+		}
+		// The sink has the standard output already, all messages must go somewhere else from now on
+		if archivePath == "-" {
+			os.Stdout = os.Stderr
+		}
+	}
+
+	// The journal records the progress next to the archive, so an interrupted run can be resumed
+	if !*catalogOnly && previous == nil && archiveFormat.Resumable() && archivePath != "-" {
+		if *resume != "" {
+			journal, err = zipfactory.OpenJournal(zipfactory.JournalPath(archivePath))
+		} else {
+			journal, err = zipfactory.CreateJournal(zipfactory.JournalPath(archivePath))
+		}
+		if err != nil {
+			log.Fatalln(err)
+		}
+		opts.Journal = journal
+	}
+	crawler.Configure(opts)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Stop crawling and finish the archive on Ctrl-C; a second signal kills the program
+	go func() {
+		var signals = make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		<-signals
+		signal.Stop(signals)
+
+		fmt.Println("\nInterrupted, finishing the archive. Press Ctrl-C again to exit immediately.")
+		cancel()
+	}()
+
+	// Rows that crawlers dropped are collected for skipped.json
+	var (
+		skippedLock sync.Mutex
+		skipped     []interface{}
+	)
+
 	var output = make(chan zipfactory.Archivable, 25)
 	go func() {
-		// // Crawl ccan.de and return its items
-		fmt.Println("Downloading CCAN items")
-		errorsCCAN := crawler.CrawlCCAN(output)
-		fmt.Printf("There were %d errors while downloading from ccan.de: \n", len(errorsCCAN))
-		for _, err := range errorsCCAN {
-			fmt.Println(err.Error())
-		}
+		for _, src := range sources {
+			if ctx.Err() != nil {
+				break
+			}
+
+			fmt.Printf("Downloading %s items\n", src.Description())
+			errs := crawler.Errors(src.Crawl(ctx, output))
+			fmt.Printf("There were %d errors while downloading from %s: \n", len(errs), src.Description())
+			for _, err := range errs {
+				fmt.Println(err.Error())
 
-		// Crawl an archive of clonk-center.net and return its items
-		fmt.Println("Downloading Clonk-Center items")
-		errorsCC := crawler.CrawlClonkCenter(output)
-		fmt.Printf("There were %d errors while downloading from cc-archive.lwrl.de: \n", len(errorsCC))
-		for _, err := range errorsCC {
-			fmt.Println(err.Error())
+				if row, ok := err.(*crawler.SkippedRow); ok {
+					skippedLock.Lock()
+					skipped = append(skipped, row)
+					skippedLock.Unlock()
+				}
+			}
 		}
 
 		close(output)
 	}()
 
-	if err := zipfactory.CreateZipFileFromItems(output); err != nil {
+	if *catalogOnly {
+		var basename = catalog.FormatBasename()
+		count, err := catalog.CreateCatalogFiles(ctx, output, basename)
+		if err == context.Canceled {
+			fmt.Printf("Crawling was interrupted, %s.jsonl and %s.csv only contain %d items.\n", basename, basename, count)
+			return
+		}
+		if err != nil {
+			log.Fatalln(err)
+		}
+
+		fmt.Printf("Wrote %d items to %s.jsonl and %s.csv\n", count, basename, basename)
+		return
+	}
+
+	// In update mode, only new and changed items are downloaded
+	var (
+		archiveInput <-chan zipfactory.Archivable = output
+		changes      *update.Update
+		extraFiles   func() map[string]interface{}
+	)
+	if previous != nil {
+		var mode = update.Full
+		if *delta {
+			mode = update.Delta
+		}
+		archiveInput, changes = previous.Filter(ctx, output, mode)
+		extraFiles = func() map[string]interface{} {
+			return map[string]interface{}{"changelog.json": changes.Changelog()}
+		}
+	}
+
+	err = zipfactory.CreateZipFileFromItems(ctx, archiveInput, zipfactory.Options{
+		Sink:        sink,
+		Journal:     journal,
+		Resume:      *resume != "",
+		Fetcher:     &downloader,
+		Downloaders: *downloads,
+		SpoolBudget: *spoolBudget << 20,
+		TempDir:     *spoolDir,
+		Dedup:       *dedup,
+		Layout:      itemLayout,
+		Extra:       extraFiles,
+		Skipped: func() []interface{} {
+			skippedLock.Lock()
+			defer skippedLock.Unlock()
+			return append([]interface{}{}, skipped...)
+		},
+	})
+	if journal != nil {
+		if jerr := journal.Close(); err == nil {
+			err = jerr
+		}
+	}
+	if changes != nil {
+		changelog := changes.Changelog()
+		fmt.Printf("Compared to %s: %d added, %d updated, %d removed, %d unchanged and %d not crawled again\n", *updateFrom,
+			len(changelog.Added), len(changelog.Updated), len(changelog.Removed), changelog.Unchanged, changelog.NotCrawled)
+	}
+	if err == context.Canceled {
+		if journal == nil {
+			println("Download was interrupted, the archive only contains the items that were completed.")
+			return
+		}
+		// Items that were archived already keep their path, new ones should get the same layout
+		println("Download was interrupted, the archive only contains the items that were completed. Continue it using -format", archiveFormat, "-layout", strconv.Quote(*layout), "-resume", archivePath)
+		return
+	}
+	if err != nil {
 		log.Fatalln(err)
 	}
 
+	// The journal is only needed to resume the run
+	if journal != nil {
+		_ = os.Remove(zipfactory.JournalPath(archivePath))
+	}
+
 	println("Finished downloading.")
 }
+
+// splitList splits a comma-separated flag value, ignoring empty elements
+func splitList(in string) (out []string) {
+	for _, s := range strings.Split(in, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			out = append(out, s)
+		}
+	}
+	return
+}
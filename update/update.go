@@ -0,0 +1,458 @@
+// Package update compares crawled items with an earlier archive, so only new and changed items need to be downloaded
+package update
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/xarantolus/ccan-archiver/zipfactory"
+)
+
+// Mode decides which items end up in the new archive
+type Mode int
+
+const (
+	// Full archives contain all items: new and changed ones are downloaded, all others are copied from the previous archive
+	Full Mode = iota
+	// Delta archives only contain new and changed items
+	Delta
+)
+
+// DeltaOutput is the name of delta archives, see zipfactory.OutputPath
+const DeltaOutput = "CCAN-Clonk-Center-Delta-{{.Date}}{{.Ext}}"
+
+// DeltaFilename returns the name of a delta archive in the given format created today
+func DeltaFilename(format zipfactory.Format) string {
+	name, _ := zipfactory.OutputPath(DeltaOutput, format)
+	return name
+}
+
+var (
+	// volatileFields change all the time, they are updated in the metadata, but don't make an item count as changed
+	volatileFields = map[string]bool{"download_count": true, "votes": true, "rating": true}
+
+	// fileFields indicate that the file itself has changed, so it must be downloaded again
+	fileFields = map[string]bool{"date": true, "size": true, "sha256": true}
+
+	// archiveFields are added to the metadata when archiving, crawled items don't have them
+	archiveFields = map[string]bool{"file": true, "source": true}
+)
+
+// Previous is an earlier archive
+type Previous struct {
+	Path string
+
+	r     *zip.ReadCloser
+	items map[string]*previousItem // by download link
+	order []*previousItem          // in the order of the archive
+
+	// newestCCAN is the upload date of the newest CCAN item
+	newestCCAN time.Time
+}
+
+// previousItem is an item of an earlier archive. It is archived again as it is if it was not crawled
+type previousItem struct {
+	source string
+	file   *zip.File
+
+	raw      json.RawMessage
+	metadata map[string]json.RawMessage
+	link     string
+	date     time.Time
+
+	seen bool
+}
+
+func (p *previousItem) GetDownloadLink() string {
+	return p.link
+}
+
+func (p *previousItem) GetAuthor() string {
+	return p.field("author")
+}
+
+func (p *previousItem) GetName() string {
+	return p.field("name")
+}
+
+func (p *previousItem) GetSourceName() string {
+	return p.source
+}
+
+// MarshalJSON returns the metadata exactly as it was in the earlier archive
+func (p *previousItem) MarshalJSON() ([]byte, error) {
+	return p.raw, nil
+}
+
+// OpenStored implements zipfactory.Stored. The name is the one the file was originally downloaded with, if it is known
+func (p *previousItem) OpenStored() (io.ReadCloser, string, error) {
+	var info struct {
+		OriginalName string `json:"original_name"`
+	}
+	name := p.file.Name
+	if json.Unmarshal(p.metadata["file"], &info) == nil && info.OriginalName != "" {
+		name = info.OriginalName
+	}
+
+	rc, err := p.file.Open()
+	return rc, name, err
+}
+
+// GetDate implements zipfactory.Dated
+func (p *previousItem) GetDate() time.Time {
+	return p.date
+}
+
+func (p *previousItem) field(name string) (s string) {
+	_ = json.Unmarshal(p.metadata[name], &s)
+	return
+}
+
+// storedItem is a crawled item whose file is copied from the earlier archive
+type storedItem struct {
+	zipfactory.Archivable
+	prev *previousItem
+}
+
+// MarshalJSON returns the metadata of the crawled item
+func (s storedItem) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.Archivable)
+}
+
+// OpenStored implements zipfactory.Stored
+func (s storedItem) OpenStored() (io.ReadCloser, string, error) {
+	return s.prev.OpenStored()
+}
+
+// GetDate implements zipfactory.Dated
+func (s storedItem) GetDate() time.Time {
+	if dated, ok := s.Archivable.(zipfactory.Dated); ok {
+		return dated.GetDate()
+	}
+	return time.Time{}
+}
+
+// Open reads the metadata of all items in the archive at path. It must be closed after the update is finished
+func Open(path string) (p *Previous, err error) {
+	r, err := zip.OpenReader(path)
+	if err != nil {
+		return nil, err
+	}
+	p = &Previous{
+		Path:  path,
+		r:     r,
+		items: make(map[string]*previousItem),
+	}
+
+	var files = make(map[string]*zip.File, len(r.File))
+	for _, f := range r.File {
+		files[f.Name] = f
+	}
+
+	// Every item is stored in a folder, by default source/author/name.ext, with its metadata in source/author/name.ext.json;
+	// files in the root like README.md are not items. Quarantined items are downloaded again. If the file of an item is somewhere else, e.g. because
+	// it is the same as the one of another item, its path is in the metadata
+	for _, f := range r.File {
+		if !strings.HasSuffix(f.Name, ".json") || !strings.Contains(f.Name, "/") || strings.HasPrefix(f.Name, zipfactory.QuarantineDir+"/") {
+			continue
+		}
+
+		item, err := readItem(f)
+		if err != nil {
+			r.Close()
+			return nil, fmt.Errorf("while reading %s from %s: %w", f.Name, path, err)
+		}
+
+		filePath := strings.TrimSuffix(f.Name, ".json")
+		var info struct {
+			Path string `json:"path"`
+		}
+		if json.Unmarshal(item.metadata["file"], &info) == nil && info.Path != "" {
+			filePath = info.Path
+		}
+		if item.file = files[filePath]; item.file == nil {
+			continue
+		}
+
+		if _, dup := p.items[item.link]; dup || item.link == "" {
+			continue
+		}
+
+		p.items[item.link] = item
+		p.order = append(p.order, item)
+		if item.source == "CCAN" && item.date.After(p.newestCCAN) {
+			p.newestCCAN = item.date
+		}
+	}
+
+	return p, nil
+}
+
+func readItem(metadata *zip.File) (item *previousItem, err error) {
+	rc, err := metadata.Open()
+	if err != nil {
+		return
+	}
+	raw, err := ioutil.ReadAll(rc)
+	rc.Close()
+	if err != nil {
+		return
+	}
+
+	item = &previousItem{raw: raw}
+	if err = json.Unmarshal(raw, &item.metadata); err != nil {
+		return nil, err
+	}
+	// Archives created before the path layout was configurable only have the source as first folder
+	if item.source = item.field("source"); item.source == "" {
+		item.source = metadata.Name[:strings.Index(metadata.Name, "/")]
+	}
+	item.link = item.field("download_link")
+	// Items without date are never treated as removed
+	_ = json.Unmarshal(item.metadata["date"], &item.date)
+
+	return item, nil
+}
+
+// Close closes the archive
+func (p *Previous) Close() error {
+	return p.r.Close()
+}
+
+// NewestCCAN returns the upload date of the newest CCAN item. The CCAN crawl can stop at it, see crawler.Options.CCANStopBefore
+func (p *Previous) NewestCCAN() time.Time {
+	return p.newestCCAN
+}
+
+// Len returns the number of items in the archive
+func (p *Previous) Len() int {
+	return len(p.order)
+}
+
+// Changelog lists the differences between the previous and the new archive
+type Changelog struct {
+	Previous string           `json:"previous"` // path of the previous archive
+	Added    []ChangelogEntry `json:"added"`
+	Updated  []ChangelogEntry `json:"updated"`
+	Removed  []ChangelogEntry `json:"removed"`
+
+	// Unchanged is the number of items that were crawled again, but didn't change
+	Unchanged int `json:"unchanged"`
+	// NotCrawled is the number of items that weren't crawled again, e.g. because they are older than the newest CCAN item
+	NotCrawled int `json:"not_crawled"`
+}
+
+// ChangelogEntry is an item that was added, updated or removed
+type ChangelogEntry struct {
+	Source       string `json:"source"`
+	Name         string `json:"name"`
+	Author       string `json:"author"`
+	DownloadLink string `json:"download_link"`
+
+	// Changes are the names of the fields that changed
+	Changes []string `json:"changes,omitempty"`
+}
+
+func newEntry(item zipfactory.Archivable, changes []string) ChangelogEntry {
+	return ChangelogEntry{
+		Source:       item.GetSourceName(),
+		Name:         item.GetName(),
+		Author:       item.GetAuthor(),
+		DownloadLink: item.GetDownloadLink(),
+		Changes:      changes,
+	}
+}
+
+// Update filters crawled items, see Previous.Filter
+type Update struct {
+	prev *Previous
+	mode Mode
+
+	lock      sync.Mutex
+	changelog Changelog
+}
+
+// Filter sends all items from input that are new or changed since the previous archive to the returned channel, which is closed after input.
+// Items whose file changed are downloaded again; if only their metadata changed, the file is copied from the previous archive.
+// In Full mode, unchanged items are passed too, reading their files from the previous archive. After input is closed,
+// items that weren't crawled again are passed as they were in the previous archive, so nothing is lost.
+//
+// Items that weren't crawled again are reported as removed, except for CCAN items older than NewestCCAN and
+// items of sources that didn't return any items at all
+func (p *Previous) Filter(ctx context.Context, input <-chan zipfactory.Archivable, mode Mode) (<-chan zipfactory.Archivable, *Update) {
+	var (
+		u      = &Update{prev: p, mode: mode, changelog: Changelog{Previous: p.Path}}
+		output = make(chan zipfactory.Archivable)
+	)
+
+	go func() {
+		defer close(output)
+
+		var crawledSources = make(map[string]bool)
+	loop:
+		for {
+			var item zipfactory.Archivable
+			select {
+			case <-ctx.Done():
+				return
+			case i, ok := <-input:
+				if !ok {
+					break loop
+				}
+				item = i
+			}
+			crawledSources[item.GetSourceName()] = true
+
+			if out := u.classify(item); out != nil {
+				select {
+				case output <- out:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+
+		for _, prev := range p.order {
+			if prev.seen {
+				continue
+			}
+
+			u.lock.Lock()
+			removed := crawledSources[prev.source] && !(prev.source == "CCAN" && prev.date.Before(p.newestCCAN))
+			if removed {
+				u.changelog.Removed = append(u.changelog.Removed, newEntry(prev, nil))
+			} else {
+				u.changelog.NotCrawled++
+			}
+			u.lock.Unlock()
+
+			if mode == Full {
+				select {
+				case output <- prev:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+
+	return output, u
+}
+
+// classify records item in the changelog and returns what should be archived for it, or nil
+func (u *Update) classify(item zipfactory.Archivable) zipfactory.Archivable {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	prev, ok := u.prev.items[item.GetDownloadLink()]
+	if !ok {
+		u.changelog.Added = append(u.changelog.Added, newEntry(item, nil))
+		return item
+	}
+	if prev.seen {
+		return nil // crawled twice, the archive skips it anyway
+	}
+	prev.seen = true
+
+	changes, fileChanged, err := compare(prev.metadata, item)
+	if err != nil {
+		// We cannot tell whether it changed, so it's better to download it again
+		changes, fileChanged = []string{"unknown"}, true
+	}
+
+	switch {
+	case fileChanged:
+		u.changelog.Updated = append(u.changelog.Updated, newEntry(item, changes))
+		return item
+	case len(changes) > 0:
+		u.changelog.Updated = append(u.changelog.Updated, newEntry(item, changes))
+		return storedItem{item, prev}
+	default:
+		u.changelog.Unchanged++
+		if u.mode == Full {
+			return storedItem{item, prev}
+		}
+		return nil
+	}
+}
+
+// compare returns the sorted names of all fields of the metadata of item that differ from previous, ignoring volatileFields,
+// archiveFields and fields whose earlier value is unknown
+func compare(previous map[string]json.RawMessage, item zipfactory.Archivable) (changes []string, fileChanged bool, err error) {
+	content, err := json.Marshal(item)
+	if err != nil {
+		return
+	}
+	var current map[string]json.RawMessage
+	if err = json.Unmarshal(content, &current); err != nil {
+		return
+	}
+
+	var fields = make(map[string]bool)
+	for name := range previous {
+		fields[name] = true
+	}
+	for name := range current {
+		fields[name] = true
+	}
+
+	for name := range fields {
+		before, inPrevious := previous[name]
+		after, inCurrent := current[name]
+		switch {
+		case volatileFields[name] || archiveFields[name] || equalJSON(before, after):
+			continue
+		case !inPrevious:
+			// Older archives don't have fields that were added later, so their value is unknown instead of changed
+			continue
+		case fileFields[name] && (!inCurrent || unknownValue(before) || unknownValue(after)):
+			continue
+		}
+		changes = append(changes, name)
+		if fileFields[name] {
+			fileChanged = true
+		}
+	}
+	sort.Strings(changes)
+
+	return
+}
+
+// unknownValue returns whether a field says nothing about the file, e.g. a size of 0
+func unknownValue(v json.RawMessage) bool {
+	switch string(bytes.TrimSpace(v)) {
+	case "", "null", "0", `""`:
+		return true
+	}
+	return false
+}
+
+// equalJSON compares json values, ignoring whitespace
+func equalJSON(a, b json.RawMessage) bool {
+	var ca, cb bytes.Buffer
+	if json.Compact(&ca, a) != nil || json.Compact(&cb, b) != nil {
+		return bytes.Equal(a, b)
+	}
+	return bytes.Equal(ca.Bytes(), cb.Bytes())
+}
+
+// Changelog returns the changes found so far. It is complete after the channel returned by Filter has been closed
+func (u *Update) Changelog() Changelog {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	c := u.changelog
+	c.Added = append([]ChangelogEntry{}, c.Added...)
+	c.Updated = append([]ChangelogEntry{}, c.Updated...)
+	c.Removed = append([]ChangelogEntry{}, c.Removed...)
+	return c
+}
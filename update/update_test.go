@@ -0,0 +1,265 @@
+package update
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/xarantolus/ccan-archiver/crawler"
+	"github.com/xarantolus/ccan-archiver/crawler/crawlertest"
+	"github.com/xarantolus/ccan-archiver/zipfactory"
+)
+
+func ccanItem(id string, date time.Time) crawler.CCANItem {
+	return crawler.CCANItem{
+		Name:         "Item " + id,
+		Author:       "Author",
+		Date:         date,
+		Category:     "Melee",
+		DownloadLink: "https://ccan.de/files/" + id + ".c4s",
+		Votes:        1,
+	}
+}
+
+// file is the content that is served for item. It is binary like real downloads, so it isn't quarantined
+func file(item crawler.CCANItem, version string) string {
+	return "\x00" + item.DownloadLink + version
+}
+
+// serve starts a fake server that serves the files of items in the given version. It must be closed after use
+func serve(version string, items ...crawler.CCANItem) *crawlertest.Server {
+	srv := crawlertest.NewServer()
+	for _, item := range items {
+		srv.Files[item.DownloadLink] = []byte(file(item, version))
+	}
+	return srv
+}
+
+func archive(t *testing.T, path string, items []zipfactory.Archivable, fetcher zipfactory.Fetcher) {
+	var input = make(chan zipfactory.Archivable, len(items))
+	for _, item := range items {
+		input <- item
+	}
+	close(input)
+
+	if err := zipfactory.CreateZipFileFromItems(context.Background(), input, zipfactory.Options{Path: path, Fetcher: fetcher}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUpdate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "update-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var (
+		day       = func(d int) time.Time { return time.Date(2020, 1, d, 0, 0, 0, 0, time.UTC) }
+		unchanged = ccanItem("unchanged", day(5))
+		newFile   = ccanItem("new-file", day(6))
+		newMeta   = ccanItem("new-meta", day(4))
+		removed   = ccanItem("removed", day(7))
+		old       = ccanItem("old", day(1))
+	)
+
+	previousPath := filepath.Join(dir, "previous.zip")
+	previousServer := serve("-v1", removed, newFile, unchanged, newMeta, old)
+	defer previousServer.Close()
+	archive(t, previousPath, []zipfactory.Archivable{removed, newFile, unchanged, newMeta, old}, previousServer.Fetcher())
+
+	prev, err := Open(previousPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer prev.Close()
+
+	if prev.Len() != 5 || !prev.NewestCCAN().Equal(day(7)) {
+		t.Fatalf("expected 5 items with the newest from %s, got %d items and %s", day(7), prev.Len(), prev.NewestCCAN())
+	}
+
+	// The crawl stops before "old", "removed" is gone
+	unchanged.Votes = 20
+	newFile.Date = day(8)
+	newMeta.Category = "Race"
+	added := ccanItem("added", day(9))
+
+	var input = make(chan zipfactory.Archivable, 4)
+	for _, item := range []crawler.CCANItem{added, newFile, unchanged, newMeta} {
+		input <- item
+	}
+	close(input)
+
+	filtered, u := prev.Filter(context.Background(), input, Full)
+
+	srv := serve("-v2", added, newFile, unchanged, newMeta)
+	defer srv.Close()
+	path := filepath.Join(dir, "new.zip")
+	err = zipfactory.CreateZipFileFromItems(context.Background(), filtered, zipfactory.Options{
+		Path:    path,
+		Fetcher: srv.Fetcher(),
+		Extra: func() map[string]interface{} {
+			return map[string]interface{}{"changelog.json": u.Changelog()}
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(srv.Requests(), []string{added.DownloadLink, newFile.DownloadLink}) {
+		t.Errorf("expected only new and changed files to be downloaded, got %v", srv.Requests())
+	}
+
+	changelog := u.Changelog()
+	var names = func(entries []ChangelogEntry) (names []string) {
+		for _, e := range entries {
+			names = append(names, e.Name+":"+strings.Join(e.Changes, ","))
+		}
+		return
+	}
+	if got := names(changelog.Added); !reflect.DeepEqual(got, []string{"Item added:"}) {
+		t.Errorf("unexpected added items %v", got)
+	}
+	if got := names(changelog.Updated); !reflect.DeepEqual(got, []string{"Item new-file:date", "Item new-meta:category"}) {
+		t.Errorf("unexpected updated items %v", got)
+	}
+	if got := names(changelog.Removed); !reflect.DeepEqual(got, []string{"Item removed:"}) {
+		t.Errorf("unexpected removed items %v", got)
+	}
+	if changelog.Unchanged != 1 || changelog.NotCrawled != 1 {
+		t.Errorf("expected one unchanged and one item that was not crawled, got %d and %d", changelog.Unchanged, changelog.NotCrawled)
+	}
+
+	// The full archive contains everything, copied files keep their content
+	r, err := zip.OpenReader(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	var files = make(map[string]string)
+	for _, f := range r.File {
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, _ := ioutil.ReadAll(rc)
+		rc.Close()
+		files[f.Name] = string(content)
+	}
+
+	for name, content := range map[string]string{
+		"CCAN/Author/Item added.c4s":     file(added, "-v2"),
+		"CCAN/Author/Item new-file.c4s":  file(newFile, "-v2"),
+		"CCAN/Author/Item new-meta.c4s":  file(newMeta, "-v1"),
+		"CCAN/Author/Item unchanged.c4s": file(unchanged, "-v1"),
+		"CCAN/Author/Item removed.c4s":   file(removed, "-v1"),
+		"CCAN/Author/Item old.c4s":       file(old, "-v1"),
+	} {
+		if files[name] != content {
+			t.Errorf("expected %s to contain %q, got %q", name, content, files[name])
+		}
+	}
+
+	var meta crawler.CCANItem
+	if err = json.Unmarshal([]byte(files["CCAN/Author/Item unchanged.c4s.json"]), &meta); err != nil || meta.Votes != 20 {
+		t.Errorf("expected the metadata of copied items to be updated, got %+v", meta)
+	}
+	if _, ok := files["changelog.json"]; !ok {
+		t.Errorf("changelog.json is missing")
+	}
+}
+
+func TestDelta(t *testing.T) {
+	prev := &Previous{items: map[string]*previousItem{}}
+	unchanged := ccanItem("unchanged", time.Now())
+
+	content, _ := json.Marshal(unchanged)
+	item := &previousItem{source: "CCAN", raw: content, link: unchanged.DownloadLink}
+	json.Unmarshal(content, &item.metadata)
+	prev.items[item.link], prev.order = item, []*previousItem{item}
+
+	var input = make(chan zipfactory.Archivable, 2)
+	input <- unchanged
+	input <- ccanItem("added", time.Now())
+	close(input)
+
+	filtered, _ := prev.Filter(context.Background(), input, Delta)
+	var links []string
+	for item := range filtered {
+		links = append(links, item.GetDownloadLink())
+	}
+	if len(links) != 1 || !strings.HasSuffix(links[0], "added.c4s") {
+		t.Errorf("expected only the new item in a delta, got %v", links)
+	}
+}
+
+func TestOpenLayout(t *testing.T) {
+	dir, err := ioutil.TempDir("", "update-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	layout, err := zipfactory.ParseLayout("{{.Category}}/{{.Year}}/{{.Name}}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var (
+		date  = time.Date(2020, 1, 5, 0, 0, 0, 0, time.UTC)
+		input = make(chan zipfactory.Archivable, 1)
+		path  = filepath.Join(dir, "layout.zip")
+	)
+	item := ccanItem("item", date)
+	input <- item
+	close(input)
+	srv := serve("", item)
+	defer srv.Close()
+	err = zipfactory.CreateZipFileFromItems(context.Background(), input, zipfactory.Options{Path: path, Fetcher: srv.Fetcher(), Layout: layout})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The source is not part of the path, but in the metadata
+	prev, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer prev.Close()
+	if prev.Len() != 1 || !prev.NewestCCAN().Equal(date) {
+		t.Errorf("expected the CCAN item from %s, got %d items and %s", date, prev.Len(), prev.NewestCCAN())
+	}
+}
+
+func TestClassifyOldMetadata(t *testing.T) {
+	// Archives created before type, size and the file info were added to the metadata
+	const old = `{
+    "name": "Item old",
+    "date": "2020-01-05T00:00:00Z",
+    "download_count": 3,
+    "author": "Author",
+    "votes": 1,
+    "category": "Melee",
+    "engine": "",
+    "download_link": "https://ccan.de/files/old.c4s"
+}`
+	item := &previousItem{source: "CCAN", raw: []byte(old), link: "https://ccan.de/files/old.c4s"}
+	if err := json.Unmarshal(item.raw, &item.metadata); err != nil {
+		t.Fatal(err)
+	}
+	prev := &Previous{items: map[string]*previousItem{item.link: item}}
+	u := &Update{prev: prev, mode: Full}
+
+	crawled := ccanItem("old", time.Date(2020, 1, 5, 0, 0, 0, 0, time.UTC))
+	crawled.Type, crawled.Size, crawled.DownloadCount = "Scenario", 1234, 10
+	if _, ok := u.classify(crawled).(storedItem); !ok || u.changelog.Unchanged != 1 {
+		t.Errorf("expected the item to be unchanged, got changelog %+v", u.changelog)
+	}
+}
@@ -0,0 +1,161 @@
+package zipfactory
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+func newArchive(sink Sink, journal *Journal, layout *Layout) *archive {
+	return &archive{
+		sink:      sink,
+		journal:   journal,
+		layout:    layout,
+		paths:     make(map[string]bool),
+		itemCount: 1,
+	}
+}
+
+// commit records an item whose entries have been written in the journal. The sink is synced first, so the
+// journal never contains items that are not on disk
+func (a *archive) commit(link string, file fileInfo) error {
+	js, ok := a.sink.(journaledSink)
+	if !ok {
+		return nil
+	}
+	entries, end, err := js.checkpoint(a.journal != nil)
+	if err != nil || a.journal == nil {
+		return err
+	}
+	return a.journal.itemArchived(journalItem{Link: link, Entries: entries, File: file, End: end})
+}
+
+// recover restores all items in the journal, so they are kept in the archive
+func (a *archive) recover() error {
+	js, ok := a.sink.(journaledSink)
+	if !ok {
+		return fmt.Errorf("%T cannot be resumed", a.sink)
+	}
+	if err := js.recover(a.journal.items); err != nil {
+		return err
+	}
+	for _, item := range a.journal.items {
+		for _, e := range item.Entries {
+			a.paths[strings.ToLower(e.Name)] = true
+		}
+		if item.File.Quarantine != "" {
+			a.quarantined++
+			continue
+		}
+		a.addBlob(item.File)
+		a.itemCount++
+	}
+	return nil
+}
+
+// uniquePath returns the path for the file of item: name with ext, if no other item uses it yet. Otherwise the upload date
+// of the item is added, and if that isn't enough a hash of its download link. As most file systems on Windows and macOS
+// ignore the case, so do the comparisons. The path and the one of the metadata are reserved for item
+func (a *archive) uniquePath(item Archivable, name, ext string) string {
+	var suffixes = []string{""}
+	if dated, ok := item.(Dated); ok && !dated.GetDate().IsZero() {
+		suffixes = append(suffixes, fmt.Sprintf(" (%s)", dated.GetDate().Format("2006-01-02")))
+	}
+	sum := sha256.Sum256([]byte(item.GetDownloadLink()))
+	suffixes = append(suffixes, fmt.Sprintf(" (%x)", sum[:4]))
+
+	for n := 2; ; n++ {
+		for _, suffix := range suffixes {
+			path := name + suffix
+			if ext != "" {
+				path += "." + ext
+			}
+			if lower := strings.ToLower(path); !a.paths[lower] && !a.paths[lower+".json"] {
+				a.paths[lower], a.paths[lower+".json"] = true, true
+				return path
+			}
+		}
+		// Different links with the same hash prefix are very unlikely, but not impossible
+		suffixes = []string{fmt.Sprintf(" (%x %d)", sum[:4], n)}
+	}
+}
+
+// fileInfo describes where the file of an item is in the archive. It is added to the metadata of the item as "file"
+type fileInfo struct {
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+
+	// OriginalName is the name the server sent the file with, if it is known
+	OriginalName string `json:"original_name,omitempty"`
+
+	// Quarantine is the reason why the file was put into QuarantineDir
+	Quarantine string `json:"quarantine_reason,omitempty"`
+}
+
+// addBlob records the file of an item that has been archived, so later items with the same content can point to it
+func (a *archive) addBlob(file fileInfo) {
+	if a.blobs == nil || file.SHA256 == "" || file.Quarantine != "" {
+		return
+	}
+	if _, ok := a.blobs[file.SHA256]; ok {
+		a.duplicates++
+		a.savedBytes += file.Size
+		return
+	}
+	a.blobs[file.SHA256] = file.Path
+}
+
+// itemMetadata returns the indented json metadata of item with its source added as "source" and file as "file",
+// as the path of an item depends on the layout. If the metadata already has these fields, e.g. because it was copied
+// from an earlier archive, they are replaced
+func itemMetadata(item Archivable, file fileInfo) ([]byte, error) {
+	content, err := json.Marshal(item)
+	if err != nil {
+		return nil, err
+	}
+	fileJSON, err := json.Marshal(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+
+	dec := json.NewDecoder(bytes.NewReader(content))
+	if t, err := dec.Token(); err != nil || t != json.Delim('{') {
+		return nil, fmt.Errorf("metadata is not a json object")
+	}
+	for dec.More() {
+		t, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		var value json.RawMessage
+		if err = dec.Decode(&value); err != nil {
+			return nil, err
+		}
+		if t == "file" || t == "source" {
+			continue
+		}
+
+		key, _ := json.Marshal(t)
+		buf.Write(key)
+		buf.WriteByte(':')
+		buf.Write(value)
+		buf.WriteByte(',')
+	}
+
+	source, _ := json.Marshal(item.GetSourceName())
+	buf.WriteString(`"source":`)
+	buf.Write(source)
+	buf.WriteString(`,"file":`)
+	buf.Write(fileJSON)
+	buf.WriteByte('}')
+
+	var out bytes.Buffer
+	err = json.Indent(&out, buf.Bytes(), "", "    ")
+	return out.Bytes(), err
+}
@@ -0,0 +1,233 @@
+package zipfactory
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDedup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "zipfactory-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var fetcher = &testFetcher{files: map[string]string{
+		"https://example.com/a.c4d": "same content",
+		"https://example.com/b.c4d": "other content",
+		"https://example.com/c.c4d": "same content",
+	}}
+	var input = make(chan Archivable, 3)
+	for _, link := range []string{"https://example.com/a.c4d", "https://example.com/b.c4d", "https://example.com/c.c4d"} {
+		input <- testItem{link}
+	}
+	close(input)
+
+	path := filepath.Join(dir, "archive.zip")
+	if err = CreateZipFileFromItems(context.Background(), input, Options{Path: path, Fetcher: fetcher, Dedup: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := zip.OpenReader(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	var files = make(map[string]string)
+	for _, f := range r.File {
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, _ := ioutil.ReadAll(rc)
+		rc.Close()
+		files[f.Name] = string(content)
+	}
+
+	const first, duplicate = "Test/author/httpsexample.coma.c4d.c4d", "Test/author/httpsexample.comc.c4d.c4d"
+	if files[first] != "same content" {
+		t.Errorf("expected the first file to be stored, got %q", files[first])
+	}
+	if _, ok := files[duplicate]; ok {
+		t.Errorf("the duplicate file was stored again")
+	}
+
+	var meta struct {
+		File fileInfo `json:"file"`
+	}
+	if err = json.Unmarshal([]byte(files[duplicate+".json"]), &meta); err != nil {
+		t.Fatal(err)
+	}
+	if meta.File.Path != first || meta.File.Size != int64(len("same content")) || len(meta.File.SHA256) != 64 {
+		t.Errorf("expected the metadata of the duplicate to point to %s, got %+v", first, meta.File)
+	}
+	if !strings.Contains(files["README.md"], "1 items have exactly the same file as another item") {
+		t.Errorf("the README doesn't mention the duplicate")
+	}
+}
+
+func TestQuarantine(t *testing.T) {
+	dir, err := ioutil.TempDir("", "zipfactory-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var fetcher = &testFetcher{files: map[string]string{
+		"https://example.com/a.c4d": "PK\x03\x04zip file",
+		"https://example.com/b.c4d": "<html><body>Sorry, this file does not exist</body></html>",
+	}}
+	var input = make(chan Archivable, 2)
+	input <- testItem{"https://example.com/a.c4d"}
+	input <- testItem{"https://example.com/b.c4d"}
+	close(input)
+
+	path := filepath.Join(dir, "archive.zip")
+	if err = CreateZipFileFromItems(context.Background(), input, Options{Path: path, Fetcher: fetcher, Dedup: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	files := readArchive(t, FormatZip, path)
+	const quarantined = QuarantineDir + "/Test/author/httpsexample.comb.c4d.html"
+	if _, ok := files[quarantined]; !ok {
+		t.Fatalf("expected the error page to be quarantined, got %d files", len(files))
+	}
+	if _, ok := files["Test/author/httpsexample.coma.c4d.c4d"]; !ok {
+		t.Errorf("the zip file is missing")
+	}
+
+	var meta struct {
+		File fileInfo `json:"file"`
+	}
+	if err = json.Unmarshal([]byte(files[quarantined+".json"]), &meta); err != nil || meta.File.Quarantine == "" {
+		t.Errorf("expected a reason in the metadata, got %+v", meta.File)
+	}
+	if !strings.Contains(files["README.md"], "1 downloads looked like error pages") {
+		t.Errorf("the README doesn't mention the quarantined download")
+	}
+}
+
+// datedItem is a testItem with an upload date
+type datedItem struct {
+	testItem
+	date time.Time
+}
+
+func (d datedItem) GetDate() time.Time { return d.date }
+
+func TestUniquePath(t *testing.T) {
+	var (
+		a    = newArchive(discardSink{}, nil, nil)
+		date = time.Date(2010, 5, 1, 0, 0, 0, 0, time.UTC)
+	)
+
+	var paths []string
+	for _, test := range []struct {
+		item      Archivable
+		name, ext string
+	}{
+		{datedItem{testItem{"https://example.com/1"}, date}, "CCAN/Author/Mod", "c4d"},
+		{datedItem{testItem{"https://example.com/2"}, date.AddDate(1, 0, 0)}, "CCAN/Author/Mod", "c4d"},
+		{datedItem{testItem{"https://example.com/3"}, date}, "ccan/author/MOD", "c4d"},
+		{testItem{"https://example.com/4"}, "CCAN/Author/Mod", "c4d"},
+		{datedItem{testItem{"https://example.com/5"}, date}, "CCAN/Author/Mod", "c4d"},
+		// The metadata of the first item is at this path
+		{testItem{"https://example.com/6"}, "CCAN/Author/Mod.c4d", "json"},
+	} {
+		paths = append(paths, a.uniquePath(test.item, test.name, test.ext))
+	}
+
+	expected := []string{
+		"CCAN/Author/Mod.c4d",
+		"CCAN/Author/Mod (2011-05-01).c4d",
+		"ccan/author/MOD (2010-05-01).c4d",
+		"CCAN/Author/Mod (5af70f50).c4d",
+		"CCAN/Author/Mod (6ba7a06e).c4d",
+		"CCAN/Author/Mod.c4d (c0fd8645).json",
+	}
+	if !reflect.DeepEqual(paths, expected) {
+		t.Errorf("got %q, expected %q", paths, expected)
+	}
+}
+
+// engineItem is a datedItem with the fields layouts usually use
+type engineItem struct {
+	datedItem
+	Engine   string `json:"engine"`
+	Category string `json:"category"`
+	Votes    int    `json:"votes"`
+}
+
+func TestLayout(t *testing.T) {
+	item := engineItem{
+		datedItem{testItem{"https://ccan.de/cgi-bin/ccan/ccan-dl.pl?id=42"}, time.Date(2010, 5, 1, 0, 0, 0, 0, time.UTC)},
+		"OpenClonk", "Melee/Settlement", 7,
+	}
+
+	table := map[string]string{
+		DefaultLayout: "Test/author/httpsccan.decgi-binccanccan-dl.plid42",
+		"{{.Engine}}/{{.Category}}/{{.Author}}/{{.Year}} {{.ID}}": "OpenClonk/MeleeSettlement/author/2010 42",
+		"{{.Fields.votes}}/{{.Fields.missing}}/{{.Date.Month}}":   "7/May",
+		"{{.ID}}": "Test/42",
+		"{{if eq .Engine \"OpenClonk\"}}oc{{else}}classic{{end}}/{{.Author}}/ ": "oc/author",
+	}
+	for text, expected := range table {
+		layout, err := ParseLayout(text)
+		if err != nil {
+			t.Fatalf("ParseLayout(%q): %s", text, err.Error())
+		}
+		components, err := layout.components(item)
+		if err != nil {
+			t.Fatalf("%q: %s", text, err.Error())
+		}
+		if res := itemPath("c4s", components...); res != expected {
+			t.Errorf("%q: got %q, expected %q", text, res, expected)
+		}
+	}
+
+	if _, err := ParseLayout("{{.Engin}}/{{.Name}}"); err == nil {
+		t.Errorf("expected an error for an unknown field")
+	}
+
+	if res, err := OutputPath("mirror/{{.Format}}-{{.Date}}{{.Ext}}", FormatTarGz); err != nil || res != "mirror/tar.gz-"+time.Now().Format("2006-01-02")+".tar.gz" {
+		t.Errorf("unexpected output path %q (%v)", res, err)
+	}
+	if res, err := OutputPath("{{.Time}} {{.Time.Format \"15.04\"}}", FormatZip); err != nil || !regexp.MustCompile(`^\d\d-\d\d-\d\d \d\d\.\d\d$`).MatchString(res) {
+		t.Errorf("unexpected time in output path %q (%v)", res, err)
+	}
+}
+
+func TestItemMetadata(t *testing.T) {
+	item := testItem{"https://example.com/a.c4d"}
+	meta, err := itemMetadata(struct {
+		testItem
+		Name string `json:"name"`
+		File string `json:"file"`
+	}{item, "Name", "replaced"}, fileInfo{Path: "a/b.c4d", Size: 3, SHA256: "abc"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const expected = `{
+    "name": "Name",
+    "source": "Test",
+    "file": {
+        "path": "a/b.c4d",
+        "size": 3,
+        "sha256": "abc"
+    }
+}`
+	if string(meta) != expected {
+		t.Errorf("got %s, expected %s", meta, expected)
+	}
+}
@@ -0,0 +1,112 @@
+package zipfactory
+
+import (
+	"bytes"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// partialSuffix is added to files in a directory while they are being written, so incomplete files are never mistaken for items
+const partialSuffix = ".partial"
+
+// dirSink writes all entries as files to a directory
+type dirSink struct {
+	dir string
+
+	// written are the entries since the last checkpoint
+	written []journalEntry
+}
+
+// CreateEntry implements Sink
+func (d *dirSink) CreateEntry(name string, content io.Reader, size int64, crc uint32) error {
+	return d.writeFile(journalEntry{Name: name, CRC32: crc, UncompressedSize: uint64(size)}, content)
+}
+
+// WriteMetadata implements Sink
+func (d *dirSink) WriteMetadata(name string, content []byte) error {
+	return d.writeFile(journalEntry{Name: name, CRC32: crc32.ChecksumIEEE(content), UncompressedSize: uint64(len(content))}, bytes.NewReader(content))
+}
+
+// Finalize implements Sink. All files are complete already
+func (d *dirSink) Finalize() error {
+	return nil
+}
+
+func (d *dirSink) path(name string) string {
+	return filepath.Join(d.dir, filepath.FromSlash(name))
+}
+
+// writeFile writes the file for e under a temporary name and renames it when it is complete
+func (d *dirSink) writeFile(e journalEntry, content io.Reader) error {
+	path := d.path(e.Name)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	f, err := os.Create(path + partialSuffix)
+	if err != nil {
+		return err
+	}
+	_, err = io.CopyN(f, content, int64(e.UncompressedSize))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(path+partialSuffix, path)
+	}
+	if err != nil {
+		os.Remove(path + partialSuffix)
+		return fmt.Errorf("while writing %s: %w", e.Name, err)
+	}
+
+	d.written = append(d.written, e)
+	return nil
+}
+
+func (d *dirSink) checkpoint(sync bool) (entries []journalEntry, end int64, err error) {
+	if sync {
+		for _, e := range d.written {
+			if err = syncFile(d.path(e.Name)); err != nil {
+				return
+			}
+		}
+	}
+	entries, d.written = d.written, nil
+	return entries, 0, nil
+}
+
+func syncFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Sync()
+}
+
+// recover checks that the files of all items exist and removes files that were being written when the run was interrupted.
+// Complete files of items that are not in the journal are overwritten when they are archived again
+func (d *dirSink) recover(items []journalItem) error {
+	for _, item := range items {
+		for _, e := range item.Entries {
+			info, err := os.Stat(d.path(e.Name))
+			if err != nil {
+				return fmt.Errorf("file %s of item %s is missing: %w", e.Name, item.Link, err)
+			}
+			if info.Size() != int64(e.UncompressedSize) {
+				return fmt.Errorf("file %s of item %s was recorded with %d bytes, but has %d", e.Name, item.Link, e.UncompressedSize, info.Size())
+			}
+		}
+	}
+
+	return filepath.Walk(d.dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() && strings.HasSuffix(path, partialSuffix) {
+			err = os.Remove(path)
+		}
+		return err
+	})
+}
@@ -0,0 +1,395 @@
+package zipfactory
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"sync"
+)
+
+// download is an item whose file is fetched by one of the download workers
+type download struct {
+	seq  int // position in the input, downloads are written in this order
+	item Archivable
+
+	// directURL is the url of the file after following all redirects
+	directURL string
+	// serverName is the original name of the file, ext its extension without dot. Both can be empty
+	serverName  string
+	ext         string
+	contentType string
+
+	// quarantine is the reason why the file looks like an error page instead of the expected file.
+	// quarantineExt is the extension it is stored with in that case
+	quarantine    string
+	quarantineExt string
+
+	spool spoolFile
+	// reserved is the part of the spool budget that is held by this download
+	reserved int64
+
+	// what describes the step that failed if err is set
+	what string
+	err  error
+
+	done chan struct{}
+}
+
+func (d *download) fail(what string, err error) {
+	d.what, d.err = what, err
+}
+
+// downloadAll downloads the items from input with opts.Downloaders workers and calls handle for each of them in input order.
+// handle is always called from the goroutine downloadAll runs on, so it doesn't need any locking. The spooled file of a download
+// is removed after handle returns. Items without download link and links that were already seen are skipped.
+// If ctx is done, downloads that are already finished are still handled; downloadAll returns before the first unfinished one.
+// Links in archived are skipped as well. If handle returns an error, downloadAll stops and returns it
+func downloadAll(ctx context.Context, input <-chan Archivable, fetcher Fetcher, opts Options, archived map[string]bool, handle func(d *download) error) (err error) {
+	workers := opts.Downloaders
+	if workers < 1 {
+		workers = 1
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	budget := newSpoolBudget(opts.SpoolBudget)
+	go func() {
+		<-ctx.Done()
+		budget.wake()
+	}()
+
+	var (
+		jobs    = make(chan *download)
+		pending = make(chan *download, workers)
+		wg      sync.WaitGroup
+	)
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for d := range jobs {
+				fetchItem(ctx, fetcher, budget, opts.TempDir, d)
+				close(d.done)
+			}
+		}()
+	}
+
+	// Items are queued in pending before being handed to a worker, so the order of pending is the input order
+	go func() {
+		defer close(pending)
+		defer close(jobs)
+
+		var (
+			seen = make(map[string]bool, len(archived))
+			seq  int
+		)
+		for link := range archived {
+			seen[link] = true
+		}
+		for {
+			var item Archivable
+			select {
+			case <-ctx.Done():
+				return
+			case i, ok := <-input:
+				if !ok {
+					return
+				}
+				item = i
+			}
+
+			// Check if we already have this item or there is no download link
+			if link := item.GetDownloadLink(); link == "" || seen[link] {
+				println("Already have", link)
+				continue
+			}
+			seen[item.GetDownloadLink()] = true
+
+			d := &download{seq: seq, item: item, done: make(chan struct{})}
+			seq++
+
+			select {
+			case pending <- d:
+			case <-ctx.Done():
+				return
+			}
+			select {
+			case jobs <- d:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	for d := range pending {
+		budget.setHead(d.seq)
+
+		select {
+		case <-d.done:
+		case <-ctx.Done():
+		}
+		if !isClosed(d.done) {
+			// Interrupted before it finished, so it and everything after it is dropped
+			break
+		}
+
+		err = handle(d)
+		if d.spool.File != nil {
+			_ = d.spool.Close()
+		}
+		budget.release(d.reserved)
+		if err != nil {
+			break
+		}
+	}
+
+	// Remove all files that were downloaded, but not handled anymore
+	cancel()
+	wg.Wait()
+	for d := range pending {
+		if d.spool.File != nil {
+			_ = d.spool.Close()
+		}
+	}
+	return
+}
+
+func isClosed(c chan struct{}) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
+}
+
+// fetchItem downloads the file of d into a spool file. Errors are recorded in d.
+// If the spool budget runs out, the download is dropped and started again once there is more room. Waiting with the
+// response open could keep the download the archive waits for from being started, e.g. by a limit of requests in flight
+func fetchItem(ctx context.Context, fetcher Fetcher, budget *spoolBudget, dir string, d *download) {
+	var need int64
+	for {
+		if err := budget.wait(ctx, d.seq, need); err != nil {
+			d.fail("while downloading item", err)
+			return
+		}
+		if need = fetchOnce(ctx, fetcher, budget, dir, d); need == 0 {
+			return
+		}
+	}
+}
+
+// fetchOnce does a single attempt of fetchItem. If the spool budget ran out, it returns the number of bytes it needed
+func fetchOnce(ctx context.Context, fetcher Fetcher, budget *spoolBudget, dir string, d *download) (need int64) {
+	var (
+		body          io.ReadCloser
+		contentLength int64 = -1
+	)
+	if stored, ok := d.item.(Stored); ok {
+		rc, name, err := stored.OpenStored()
+		if err != nil {
+			d.fail("while opening stored file", err)
+			return
+		}
+		body, d.serverName = rc, path.Base(name)
+	} else {
+		resp, err := fetcher.Get(ctx, d.item.GetDownloadLink())
+		if err != nil {
+			d.fail("while downloading item", err)
+			return
+		}
+
+		// The request URL is the direct url to the file if we got redirected
+		body, d.directURL, contentLength = resp.Body, resp.Request.URL.String(), resp.ContentLength
+		d.serverName = serverFilename(resp.Header.Get("Content-Disposition"), d.directURL)
+		d.contentType = resp.Header.Get("Content-Type")
+	}
+
+	var err error
+	d.spool, err = spoolBody(body, dir, func(n int64) error {
+		if err := budget.acquire(d.seq, n); err != nil {
+			need = d.reserved + n
+			return err
+		}
+		d.reserved += n
+		return nil
+	})
+	if errors.Is(err, errSpoolFull) {
+		budget.release(d.reserved)
+		d.reserved = 0
+		return need
+	}
+
+	if err != nil {
+		d.fail("while downloading file", err)
+	} else if err = verify(d, contentLength); err != nil {
+		_ = d.spool.Close()
+		d.spool = spoolFile{}
+		d.fail("while verifying file", err)
+	} else {
+		d.ext = fileExtension(d.serverName, d.directURL, d.spool)
+		d.quarantine, d.quarantineExt = quarantineReason(d.contentType, d.ext, d.spool)
+	}
+
+	if err != nil {
+		budget.release(d.reserved)
+		d.reserved = 0
+	}
+	return 0
+}
+
+// verify checks that the spooled file of d is complete and matches the checksum of its item, if there is one.
+// contentLength is the length the server announced, -1 if it is unknown
+func verify(d *download, contentLength int64) error {
+	if contentLength >= 0 && d.spool.size != contentLength {
+		return fmt.Errorf("incomplete download: got %d of %d bytes", d.spool.size, contentLength)
+	}
+
+	if v, ok := d.item.(Verifiable); ok {
+		if expected := v.GetSHA256(); expected != "" && !strings.EqualFold(expected, d.spool.sha256) {
+			return fmt.Errorf("checksum mismatch: expected sha256 %s, got %s", expected, d.spool.sha256)
+		}
+	}
+
+	return nil
+}
+
+// spoolBudget limits the number of bytes in spool files. The download at the head of the queue may always exceed it,
+// otherwise downloads that finished early could use up the budget and block the one the archive is waiting for forever
+type spoolBudget struct {
+	limit int64 // 0 or less means no limit
+
+	lock sync.Mutex
+	cond *sync.Cond
+	used int64
+	head int
+}
+
+func newSpoolBudget(limit int64) *spoolBudget {
+	b := &spoolBudget{limit: limit}
+	b.cond = sync.NewCond(&b.lock)
+	return b
+}
+
+// errSpoolFull is returned by spoolBudget.acquire if the budget is used up
+var errSpoolFull = errors.New("spool budget is used up")
+
+// acquire reserves n bytes for download number seq. It returns errSpoolFull if they don't fit into the budget
+// and seq isn't the head
+func (b *spoolBudget) acquire(seq int, n int64) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if !b.fits(seq, n) {
+		return errSpoolFull
+	}
+	b.used += n
+	return nil
+}
+
+// wait waits until n bytes can be reserved for download number seq. Once ctx is done it fails even if they could be,
+// so no download is started after the run was interrupted
+func (b *spoolBudget) wait(ctx context.Context, seq int, n int64) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if b.fits(seq, n) {
+			return nil
+		}
+		b.cond.Wait()
+	}
+}
+
+// fits returns whether n more bytes may be used by download number seq. The lock must be held
+func (b *spoolBudget) fits(seq int, n int64) bool {
+	return b.limit <= 0 || b.used == 0 || b.used+n <= b.limit || seq == b.head
+}
+
+func (b *spoolBudget) release(n int64) {
+	b.lock.Lock()
+	b.used -= n
+	b.cond.Broadcast()
+	b.lock.Unlock()
+}
+
+// setHead sets the download that may exceed the budget
+func (b *spoolBudget) setHead(seq int) {
+	b.lock.Lock()
+	b.head = seq
+	b.cond.Broadcast()
+	b.lock.Unlock()
+}
+
+// wake lets waiting downloads check whether their context is done
+func (b *spoolBudget) wake() {
+	b.lock.Lock()
+	b.cond.Broadcast()
+	b.lock.Unlock()
+}
+
+// spoolFile is a temporary file that is removed on Close. Files are staged there until they are verified and
+// can be written to the archive in one go
+type spoolFile struct {
+	*os.File
+
+	size   int64
+	sha256 string // hex checksum of the content
+	crc32  uint32
+}
+
+func (s spoolFile) Close() error {
+	err := s.File.Close()
+	_ = os.Remove(s.Name())
+	return err
+}
+
+// spoolBody reads body into a temporary file in dir and returns it, positioned at its beginning.
+// reserve is called before writing each chunk to the file. body is always closed
+func spoolBody(body io.ReadCloser, dir string, reserve func(n int64) error) (s spoolFile, err error) {
+	defer body.Close()
+
+	tmp, err := ioutil.TempFile(dir, "ccan-archiver-*")
+	if err != nil {
+		return
+	}
+	s = spoolFile{File: tmp}
+
+	hash, crc := sha256.New(), crc32.NewIEEE()
+	if s.size, err = io.Copy(io.MultiWriter(reservingWriter{s.File, reserve}, hash, crc), body); err == nil {
+		s.sha256 = hex.EncodeToString(hash.Sum(nil))
+		s.crc32 = crc.Sum32()
+		_, err = s.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		s.Close()
+		s = spoolFile{}
+	}
+	return
+}
+
+// reservingWriter calls reserve before every write
+type reservingWriter struct {
+	w       io.Writer
+	reserve func(n int64) error
+}
+
+func (r reservingWriter) Write(p []byte) (int, error) {
+	if err := r.reserve(int64(len(p))); err != nil {
+		return 0, err
+	}
+	return r.w.Write(p)
+}
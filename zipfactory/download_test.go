@@ -0,0 +1,282 @@
+package zipfactory
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type testItem struct {
+	link string
+}
+
+func (t testItem) GetDownloadLink() string { return t.link }
+func (t testItem) GetAuthor() string       { return "author" }
+func (t testItem) GetName() string         { return t.link }
+func (t testItem) GetSourceName() string   { return "Test" }
+
+// testFetcher is a fake Fetcher. It serves the content in files for links that are in it and the link itself for all
+// others, and remembers all requested links
+type testFetcher struct {
+	files map[string]string
+
+	// delay returns how long answering a request for url takes, it is optional
+	delay func(url string) time.Duration
+	// repeat serves the content this many times without Content-Length, if it is more than 0
+	repeat int
+	// slots limits the requests in flight like crawler.HostLimiter does, if it is set. A slot is held until the body is closed
+	slots chan struct{}
+
+	lock      sync.Mutex
+	requested []string
+}
+
+func (f *testFetcher) Get(ctx context.Context, url string) (*http.Response, error) {
+	f.lock.Lock()
+	f.requested = append(f.requested, url)
+	f.lock.Unlock()
+
+	if f.delay != nil {
+		select {
+		case <-time.After(f.delay(url)):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	var release = func() {}
+	if f.slots != nil {
+		select {
+		case f.slots <- struct{}{}:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		var once sync.Once
+		release = func() { once.Do(func() { <-f.slots }) }
+	}
+
+	content, ok := f.files[url]
+	if !ok {
+		content = url
+	}
+	var length = int64(len(content))
+	if f.repeat > 0 {
+		content, length = strings.Repeat(content, f.repeat), -1
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, url, nil)
+	return &http.Response{
+		StatusCode:    http.StatusOK,
+		Body:          releasingBody{ioutil.NopCloser(strings.NewReader(content)), release},
+		ContentLength: length,
+		Request:       req,
+	}, nil
+}
+
+// releasingBody calls release when it is closed
+type releasingBody struct {
+	io.ReadCloser
+	release func()
+}
+
+func (r releasingBody) Close() error {
+	r.release()
+	return r.ReadCloser.Close()
+}
+
+// slowFirst is a delay for testFetcher that makes the first of count items numbered in their link take the longest
+func slowFirst(count int) func(url string) time.Duration {
+	return func(url string) time.Duration {
+		var n int
+		fmt.Sscanf(url, "https://example.com/%d", &n)
+		return time.Duration(count-n) * time.Millisecond
+	}
+}
+
+func TestDownloadAll(t *testing.T) {
+	const count = 30
+
+	dir, err := ioutil.TempDir("", "zipfactory-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var input = make(chan Archivable, count*2)
+	for i := 0; i < count; i++ {
+		input <- testItem{fmt.Sprintf("https://example.com/%d", i)}
+	}
+	// Duplicates and items without link are skipped
+	input <- testItem{"https://example.com/0"}
+	input <- testItem{""}
+	close(input)
+
+	var handled []string
+	err = downloadAll(context.Background(), input, &testFetcher{delay: slowFirst(count), repeat: 100}, Options{Downloaders: 8, SpoolBudget: 4096, TempDir: dir}, nil, func(d *download) error {
+		if d.err != nil {
+			t.Fatalf("unexpected error %s: %s", d.what, d.err.Error())
+		}
+		content, err := ioutil.ReadAll(d.spool)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(content, []byte(strings.Repeat(d.directURL, 100))) {
+			t.Errorf("wrong content for %s", d.directURL)
+		}
+		handled = append(handled, d.item.GetDownloadLink())
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(handled) != count {
+		t.Fatalf("expected %d items, got %d", count, len(handled))
+	}
+	for i, link := range handled {
+		if want := fmt.Sprintf("https://example.com/%d", i); link != want {
+			t.Errorf("item %d is %s, expected %s", i, link, want)
+		}
+	}
+
+	// All spool files must have been removed
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 0 {
+		t.Errorf("expected no spool files to be left, but there are %d", len(files))
+	}
+}
+
+func TestDownloadInFlightLimit(t *testing.T) {
+	const count = 10
+
+	dir, err := ioutil.TempDir("", "zipfactory-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var input = make(chan Archivable, count)
+	for i := 0; i < count; i++ {
+		input <- testItem{fmt.Sprintf("https://example.com/%d", i)}
+	}
+	close(input)
+
+	// The later files are downloaded first and fill the budget, while there are more downloaders than requests
+	// may be in flight. Downloads that wait for the budget must not keep the first one from getting a slot
+	var (
+		fetcher = &testFetcher{delay: slowFirst(count), repeat: 100, slots: make(chan struct{}, 1)}
+		handled int
+		done    = make(chan error, 1)
+	)
+	go func() {
+		done <- downloadAll(context.Background(), input, fetcher, Options{Downloaders: 4, SpoolBudget: 3000, TempDir: dir}, nil, func(d *download) error {
+			if d.err != nil {
+				t.Errorf("unexpected error %s: %s", d.what, d.err.Error())
+			}
+			handled++
+			return nil
+		})
+	}()
+
+	select {
+	case err = <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("downloads are deadlocked")
+	}
+	if err != nil || handled != count {
+		t.Errorf("expected %d items, got %d (%v)", count, handled, err)
+	}
+}
+
+func TestSpoolBudget(t *testing.T) {
+	b := newSpoolBudget(100)
+	ctx := context.Background()
+
+	if err := b.acquire(1, 80); err != nil {
+		t.Fatal(err)
+	}
+
+	// Download 2 would exceed the budget, so it has to wait until something is released
+	if err := b.acquire(2, 30); err != errSpoolFull {
+		t.Fatalf("expected errSpoolFull, got %v", err)
+	}
+	var room = make(chan struct{})
+	go func() {
+		if err := b.wait(ctx, 2, 30); err != nil {
+			t.Error(err)
+		}
+		close(room)
+	}()
+
+	select {
+	case <-room:
+		t.Fatal("budget was exceeded")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	// The head may always exceed the budget
+	if err := b.acquire(0, 50); err != nil {
+		t.Fatal(err)
+	}
+
+	b.release(130)
+	<-room
+	if err := b.acquire(2, 30); err != nil {
+		t.Fatal(err)
+	}
+
+	// Waiting stops when the context is done
+	cctx, cancel := context.WithCancel(ctx)
+	b.acquire(3, 70)
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+		b.wake()
+	}()
+	if err := b.wait(cctx, 4, 10); err != context.Canceled {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+}
+
+type checksumItem struct {
+	testItem
+	sha256 string
+}
+
+func (c checksumItem) GetSHA256() string { return c.sha256 }
+
+func TestVerify(t *testing.T) {
+	// sha256 of "content"
+	const sum = "ed7002b439e9ac845f22357d822bac1444730fbdb6016d3ec9432297b9ec9f73"
+
+	var tests = []struct {
+		item          Archivable
+		contentLength int64
+		valid         bool
+	}{
+		{testItem{"a"}, -1, true},
+		{testItem{"a"}, 7, true},
+		{testItem{"a"}, 100, false},
+		{checksumItem{testItem{"a"}, ""}, 7, true},
+		{checksumItem{testItem{"a"}, strings.ToUpper(sum)}, 7, true},
+		{checksumItem{testItem{"a"}, strings.Repeat("0", 64)}, -1, false},
+	}
+
+	for i, test := range tests {
+		d := &download{item: test.item, spool: spoolFile{size: 7, sha256: sum}}
+		if err := verify(d, test.contentLength); (err == nil) != test.valid {
+			t.Errorf("test %d: expected valid=%v, got error %v", i, test.valid, err)
+		}
+	}
+}
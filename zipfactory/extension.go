@@ -0,0 +1,169 @@
+package zipfactory
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// scriptExtensions belong to pages that hand out files, not to the files themselves
+var scriptExtensions = map[string]bool{
+	"pl": true, "cgi": true, "php": true, "asp": true, "aspx": true, "jsp": true, "htm": true, "html": true,
+}
+
+// clonkGroupFiles are the files that identify the kind of a Clonk group. The first one in a group decides,
+// as the entries of the group itself come before those of groups inside it
+var clonkGroupFiles = map[string]string{
+	"DefCore.txt":  "c4d",
+	"Scenario.txt": "c4s",
+	"Folder.txt":   "c4f",
+}
+
+// fileExtension determines the extension of a downloaded file: from the file name the server sent,
+// then from the url after following all redirects and finally from the content of the file
+func fileExtension(serverName, directURL string, content io.ReaderAt) string {
+	if ext := nameExtension(serverName); ext != "" {
+		return ext
+	}
+	if ext := getURLExtension(directURL); ext != "" {
+		return ext
+	}
+	return sniffExtension(content)
+}
+
+// nameExtension returns the extension of a file name without dot if it looks like the extension of a file
+func nameExtension(name string) string {
+	ext := strings.TrimPrefix(path.Ext(name), ".")
+	if len(ext) == 0 || len(ext) > 8 || scriptExtensions[strings.ToLower(ext)] {
+		return ""
+	}
+	for _, r := range ext {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9') {
+			return ""
+		}
+	}
+	return ext
+}
+
+func getURLExtension(rawURL string) string {
+	return nameExtension(urlFilename(rawURL))
+}
+
+// urlFilename returns the last element of the path of rawURL, ignoring the query
+func urlFilename(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return ""
+	}
+	if u.Path == "" || strings.HasSuffix(u.Path, "/") {
+		return ""
+	}
+	return path.Base(u.Path)
+}
+
+// serverFilename returns the original name of a downloaded file: the one from the Content-Disposition header,
+// or the last element of the url if it has an extension
+func serverFilename(contentDisposition, directURL string) string {
+	if _, params, err := mime.ParseMediaType(contentDisposition); err == nil {
+		// Some servers send Windows paths
+		name := params["filename"]
+		if i := strings.LastIndexAny(name, `/\`); i >= 0 {
+			name = name[i+1:]
+		}
+		if name != "" {
+			return name
+		}
+	}
+
+	if name := urlFilename(directURL); getURLExtension(directURL) != "" {
+		if unescaped, err := url.PathUnescape(name); err == nil {
+			return unescaped
+		}
+		return name
+	}
+	return ""
+}
+
+// sniffExtension returns the extension of known file formats by looking at their content, or an empty string
+func sniffExtension(content io.ReaderAt) string {
+	var head = make([]byte, 8)
+	n, _ := content.ReadAt(head, 0)
+	head = head[:n]
+
+	switch {
+	case bytes.HasPrefix(head, []byte("PK\x03\x04")), bytes.HasPrefix(head, []byte("PK\x05\x06")):
+		return "zip"
+	case bytes.HasPrefix(head, []byte("Rar!\x1a\x07")):
+		return "rar"
+	case bytes.HasPrefix(head, []byte("MZ")):
+		return "exe"
+	case bytes.HasPrefix(head, []byte("BZh")):
+		return "bz2"
+	case bytes.HasPrefix(head, []byte("\x1f\x8b")):
+		return "gz"
+	case bytes.HasPrefix(head, []byte("\x1e\x8c")):
+		return clonkGroupExtension(content)
+	}
+	return ""
+}
+
+// clonkGroupExtension returns the extension of a Clonk group. Groups are gzip streams with a different magic number
+func clonkGroupExtension(content io.ReaderAt) string {
+	const searchLimit = 1 << 20
+
+	r := io.MultiReader(strings.NewReader("\x1f\x8b"), io.NewSectionReader(content, 2, searchLimit))
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return "c4g"
+	}
+	// A truncated result is fine, it only has to contain the entries of the group itself
+	data, _ := ioutil.ReadAll(io.LimitReader(zr, searchLimit))
+
+	var (
+		ext   = "c4g"
+		first = -1
+	)
+	for name, e := range clonkGroupFiles {
+		if i := bytes.Index(data, []byte(name)); i >= 0 && (first < 0 || i < first) {
+			ext, first = e, i
+		}
+	}
+	return ext
+}
+
+// textExtensions are extensions of files that are expected to be text, so they are never quarantined
+var textExtensions = map[string]bool{"txt": true, "md": true, "htm": true, "html": true, "xml": true}
+
+// quarantineReason returns why a download looks like an error page instead of the expected file and the extension
+// it should be stored with, or an empty reason if it looks fine. Files of known formats are never quarantined
+func quarantineReason(contentType, ext string, content io.ReaderAt) (reason, quarantineExt string) {
+	if textExtensions[strings.ToLower(ext)] || sniffExtension(content) != "" {
+		return "", ""
+	}
+
+	var head = make([]byte, 512)
+	n, _ := content.ReadAt(head, 0)
+	if n == 0 {
+		return "the file is empty", ""
+	}
+
+	headerType, _, _ := mime.ParseMediaType(contentType)
+	sniffedType, _, _ := mime.ParseMediaType(http.DetectContentType(head[:n]))
+	switch {
+	case sniffedType == "text/html":
+		return fmt.Sprintf("the file is an HTML page (sent as %q)", contentType), "html"
+	case headerType == "text/html" || headerType == "application/xhtml+xml":
+		return fmt.Sprintf("the server sent the file as %q", contentType), "html"
+	case (sniffedType == "text/plain" || sniffedType == "text/xml") && strings.HasPrefix(headerType, "text/"):
+		// Text alone is a weak hint, as it only means that the first bytes are printable
+		return fmt.Sprintf("the file is text (sent as %q)", contentType), "txt"
+	}
+	return "", ""
+}
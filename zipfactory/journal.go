@@ -0,0 +1,227 @@
+package zipfactory
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// JournalPath returns the path of the journal that belongs to the archive at archivePath
+func JournalPath(archivePath string) string {
+	return archivePath + ".journal"
+}
+
+// Journal records the progress of an archive in a file next to it, so an interrupted run can be resumed.
+// Every line of the file is a json object that describes either a crawled listing page or an archived item.
+// Items are only recorded after they have been written to disk completely
+type Journal struct {
+	lock sync.Mutex
+	f    *os.File
+	err  error // first error while writing, no records are written after it
+
+	// What was recorded in earlier runs
+	pages    map[journalPageKey][]string
+	items    []journalItem
+	archived map[string]bool
+}
+
+// journalRecord is a line in the journal, exactly one of its fields is set
+type journalRecord struct {
+	Page *journalPage `json:"page,omitempty"`
+	Item *journalItem `json:"item,omitempty"`
+}
+
+// journalPage is a listing page and the download links of its items
+type journalPage struct {
+	Source string   `json:"source"`
+	Page   int      `json:"page"`
+	Links  []string `json:"links"`
+}
+
+type journalPageKey struct {
+	source string
+	page   int
+}
+
+// journalItem is an item whose entries have been written to the archive
+type journalItem struct {
+	Link    string         `json:"link"`
+	Entries []journalEntry `json:"entries"`
+	File    fileInfo       `json:"file"`
+
+	// End is the offset in the archive after the last entry of this item
+	End int64 `json:"end"`
+}
+
+// journalEntry describes an entry that was written using archive.writeEntry. It contains everything needed to write the same local header again
+type journalEntry struct {
+	Name             string `json:"name"`
+	Offset           int64  `json:"offset"` // of the local file header
+	Method           uint16 `json:"method"`
+	CRC32            uint32 `json:"crc32"`
+	CompressedSize   uint64 `json:"compressed_size"`
+	UncompressedSize uint64 `json:"uncompressed_size"`
+}
+
+func (e journalEntry) header() *zip.FileHeader {
+	h := &zip.FileHeader{
+		Name:               e.Name,
+		Method:             e.Method,
+		CRC32:              e.CRC32,
+		CompressedSize64:   e.CompressedSize,
+		UncompressedSize64: e.UncompressedSize,
+	}
+	// zip.Writer.CreateRaw doesn't mark names as UTF-8 like CreateHeader does, without the flag they are read as CP437
+	if utf8.ValidString(e.Name) && strings.IndexFunc(e.Name, func(r rune) bool { return r >= utf8.RuneSelf }) >= 0 {
+		h.Flags |= zipUTF8Flag
+	}
+	return h
+}
+
+// zipUTF8Flag marks names and comments of zip entries as UTF-8
+const zipUTF8Flag = 0x800
+
+// CreateJournal creates an empty journal at path, overwriting an existing one
+func CreateJournal(path string) (*Journal, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	return &Journal{f: f}, nil
+}
+
+// OpenJournal reads the journal at path and continues writing to it.
+// If the program crashed while writing the last record, that record is removed
+func OpenJournal(path string) (j *Journal, err error) {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	j = &Journal{
+		f:        f,
+		pages:    make(map[journalPageKey][]string),
+		archived: make(map[string]bool),
+	}
+
+	var (
+		r      = bufio.NewReader(f)
+		offset int64
+	)
+	for lineNumber := 1; ; lineNumber++ {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			break // a line without newline at the end was not written completely
+		}
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+
+		var record journalRecord
+		if err = json.Unmarshal(line, &record); err != nil {
+			f.Close()
+			return nil, fmt.Errorf("invalid record in line %d of journal %s: %w", lineNumber, path, err)
+		}
+		offset += int64(len(line))
+
+		switch {
+		case record.Page != nil:
+			j.pages[journalPageKey{record.Page.Source, record.Page.Page}] = record.Page.Links
+		case record.Item != nil:
+			j.items = append(j.items, *record.Item)
+			j.archived[record.Item.Link] = true
+		}
+	}
+
+	if err = f.Truncate(offset); err == nil {
+		_, err = f.Seek(offset, io.SeekStart)
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return j, nil
+}
+
+// PageCrawled records that a listing page of source contains items with the given download links.
+// Pages without items are not recorded, as they might just not have been filled yet
+func (j *Journal) PageCrawled(source string, page int, links []string) {
+	if len(links) == 0 {
+		return
+	}
+	_ = j.write(journalRecord{Page: &journalPage{Source: source, Page: page, Links: links}}, false)
+}
+
+// PageDone returns whether the page of source was crawled in an earlier run and all of its items have been archived
+func (j *Journal) PageDone(source string, page int) bool {
+	links, ok := j.pages[journalPageKey{source, page}]
+	if !ok {
+		return false
+	}
+	for _, link := range links {
+		if !j.archived[link] {
+			return false
+		}
+	}
+	return true
+}
+
+// itemArchived records an item. The archive must have been synced to disk before
+func (j *Journal) itemArchived(item journalItem) error {
+	return j.write(journalRecord{Item: &item}, true)
+}
+
+// write appends a record to the journal. If sync is set, it waits until the record is on disk
+func (j *Journal) write(record journalRecord, sync bool) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	if j.err != nil {
+		return j.err
+	}
+	if _, err = j.f.Write(append(line, '\n')); err == nil && sync {
+		err = j.f.Sync()
+	}
+	if err != nil {
+		j.err = fmt.Errorf("while writing journal: %w", err)
+	}
+	return j.err
+}
+
+// Close closes the journal file. It returns the first error that happened while writing
+func (j *Journal) Close() error {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	err := j.f.Close()
+	if j.err != nil {
+		return j.err
+	}
+	return err
+}
+
+// checkLocalHeader checks that there is a local file header for e in r at the offset e was recorded with
+func checkLocalHeader(r io.ReaderAt, e journalEntry) error {
+	const headerLen = 30
+
+	var buf = make([]byte, headerLen+len(e.Name))
+	if _, err := r.ReadAt(buf, e.Offset); err != nil {
+		return fmt.Errorf("cannot read entry %s: %w", e.Name, err)
+	}
+	if !bytes.Equal(buf[:4], []byte("PK\x03\x04")) || string(buf[headerLen:]) != e.Name {
+		return fmt.Errorf("entry %s is not at offset %d", e.Name, e.Offset)
+	}
+	return nil
+}
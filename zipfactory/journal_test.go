@@ -0,0 +1,172 @@
+package zipfactory
+
+import (
+	"archive/zip"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func testItems(count int) <-chan Archivable {
+	var input = make(chan Archivable, count)
+	for i := 0; i < count; i++ {
+		input <- testItem{fmt.Sprintf("https://example.com/%d.c4d", i)}
+	}
+	close(input)
+	return input
+}
+
+func TestResume(t *testing.T) {
+	dir, err := ioutil.TempDir("", "zipfactory-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "archive.zip")
+
+	journal, err := CreateJournal(JournalPath(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = CreateZipFileFromItems(context.Background(), testItems(3), Options{Path: path, Journal: journal, Fetcher: &testFetcher{}, Downloaders: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	journal.PageCrawled("test", 1, []string{"https://example.com/0.c4d", "https://example.com/1.c4d"})
+	journal.PageCrawled("test", 2, []string{"https://example.com/3.c4d"})
+	if err = journal.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Simulate a crash while writing an entry and the journal
+	af, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	af.WriteString("PK\x03\x04partial entry")
+	af.Close()
+	jf, err := os.OpenFile(JournalPath(path), os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jf.WriteString(`{"item":{"link":"https://exa`)
+	jf.Close()
+
+	journal, err = OpenJournal(JournalPath(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !journal.PageDone("test", 1) || journal.PageDone("test", 2) || journal.PageDone("test", 3) {
+		t.Errorf("PageDone doesn't match the archived items")
+	}
+
+	var fetcher = &testFetcher{}
+	err = CreateZipFileFromItems(context.Background(), testItems(5), Options{Path: path, Journal: journal, Resume: true, Fetcher: fetcher, Downloaders: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = journal.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(fetcher.requested) != 2 {
+		t.Errorf("expected only the two new items to be downloaded, but got %v", fetcher.requested)
+	}
+
+	r, err := zip.OpenReader(path)
+	if err != nil {
+		t.Fatalf("resumed archive is invalid: %s", err.Error())
+	}
+	defer r.Close()
+
+	var files = make(map[string]string)
+	for _, f := range r.File {
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatalf("cannot read %s: %s", f.Name, err.Error())
+		}
+		files[f.Name] = string(content)
+	}
+
+	for i := 0; i < 5; i++ {
+		link := fmt.Sprintf("https://example.com/%d.c4d", i)
+		name := fmt.Sprintf("Test/author/httpsexample.com%d.c4d.c4d", i)
+		if files[name] != link {
+			t.Errorf("expected %s to contain %q, got %q", name, link, files[name])
+		}
+		if !strings.Contains(files[name+".json"], "{") {
+			t.Errorf("metadata of %s is missing", name)
+		}
+	}
+	if len(files) != 11 {
+		t.Errorf("expected 5 items with metadata and a README, got %d files", len(files))
+	}
+}
+
+func TestUTF8Names(t *testing.T) {
+	dir, err := ioutil.TempDir("", "zipfactory-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var (
+		path  = filepath.Join(dir, "archive.zip")
+		items = func(links ...string) <-chan Archivable {
+			var input = make(chan Archivable, len(links))
+			for _, link := range links {
+				input <- testItem{link}
+			}
+			close(input)
+			return input
+		}
+	)
+
+	journal, err := CreateJournal(JournalPath(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = CreateZipFileFromItems(context.Background(), items("https://example.com/Mühle.c4s"), Options{Path: path, Journal: journal, Fetcher: &testFetcher{}}); err != nil {
+		t.Fatal(err)
+	}
+	journal.Close()
+
+	// Entries that are written again from the journal must keep the flag
+	if journal, err = OpenJournal(JournalPath(path)); err != nil {
+		t.Fatal(err)
+	}
+	err = CreateZipFileFromItems(context.Background(), items("https://example.com/Mühle.c4s", "https://example.com/Größe.c4d"), Options{Path: path, Journal: journal, Resume: true, Fetcher: &testFetcher{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	journal.Close()
+
+	r, err := zip.OpenReader(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	var nonASCII int
+	for _, f := range r.File {
+		if f.NonUTF8 {
+			t.Errorf("%s is not marked as UTF-8", f.Name)
+		}
+		if strings.ContainsAny(f.Name, "üöß") {
+			nonASCII++
+		}
+	}
+	if nonASCII != 4 {
+		t.Errorf("expected both items with metadata to have non-ASCII names, got %d entries", nonASCII)
+	}
+}
@@ -0,0 +1,183 @@
+package zipfactory
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// DefaultLayout puts every item into a folder of its source and author
+const DefaultLayout = "{{.Source}}/{{.Author}}/{{.Name}}"
+
+// layoutSlash replaces slashes in the fields of items while executing a layout, so they don't create folders
+const layoutSlash = "\uE000"
+
+// DefaultOutput is the name of the archive if no other one is given, see OutputPath
+const DefaultOutput = "CCAN-Clonk-Center-Archiv-{{.Date}}{{.Ext}}"
+
+// Layout decides where items are put in the archive
+type Layout struct {
+	tmpl *template.Template
+}
+
+// LayoutData is what layout templates are executed with
+type LayoutData struct {
+	Source, Author, Name string
+
+	// Engine and Category are the fields of the same name in the metadata, or empty if the item doesn't have them
+	Engine, Category string
+
+	// Date is the upload date of the item and Year its year. If the date is unknown, Date is zero and Year is empty
+	Date time.Time
+	Year string
+
+	// ID identifies the item within its source: the id in its download link, or a short hash of the link
+	ID string
+
+	// Fields are all fields of the metadata by their json name, e.g. {{.Fields.username}}. Values that aren't
+	// strings are formatted as json, missing fields are empty
+	Fields map[string]string
+}
+
+// ParseLayout parses a text/template that returns the path of an item in the archive without extension.
+// Slashes separate folders; every folder and name is cleaned to work on every OS and empty ones are left out.
+// As the root of the archive is reserved for files like README.md, items are put into a folder of their
+// source if the path has no folder. The template is executed with LayoutData
+func ParseLayout(text string) (*Layout, error) {
+	tmpl, err := template.New("layout").Option("missingkey=zero").Parse(text)
+	if err != nil {
+		return nil, err
+	}
+
+	// Catch typos in field names now instead of failing every item
+	l := &Layout{tmpl: tmpl}
+	if _, err = l.components(layoutItem{}); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// layoutItem is used to test layouts in ParseLayout
+type layoutItem struct{}
+
+func (layoutItem) GetSourceName() string   { return "Source" }
+func (layoutItem) GetAuthor() string       { return "Author" }
+func (layoutItem) GetName() string         { return "Name" }
+func (layoutItem) GetDownloadLink() string { return "https://example.com/file.c4d" }
+
+// components returns the unclean folders and name of item
+func (l *Layout) components(item Archivable) ([]string, error) {
+	data, err := layoutData(item)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	if err = l.tmpl.Execute(&buf, data); err != nil {
+		return nil, err
+	}
+
+	var components []string
+	for _, c := range strings.Split(buf.String(), "/") {
+		if strings.TrimSpace(c) != "" {
+			components = append(components, strings.ReplaceAll(c, layoutSlash, "/"))
+		}
+	}
+	switch len(components) {
+	case 0:
+		return []string{item.GetSourceName(), data.ID}, nil
+	case 1:
+		return append([]string{item.GetSourceName()}, components...), nil
+	}
+	return components, nil
+}
+
+func layoutData(item Archivable) (data LayoutData, err error) {
+	escape := strings.NewReplacer("/", layoutSlash).Replace
+	data = LayoutData{
+		Source: escape(item.GetSourceName()),
+		Author: escape(item.GetAuthor()),
+		Name:   escape(item.GetName()),
+		ID:     escape(linkID(item.GetDownloadLink())),
+		Fields: make(map[string]string),
+	}
+
+	content, err := json.Marshal(item)
+	if err != nil {
+		return
+	}
+	var fields map[string]json.RawMessage
+	if err = json.Unmarshal(content, &fields); err != nil {
+		return data, fmt.Errorf("metadata is not a json object")
+	}
+	for name, value := range fields {
+		var s string
+		if json.Unmarshal(value, &s) != nil {
+			s = string(value)
+		}
+		data.Fields[name] = escape(s)
+	}
+	data.Engine, data.Category = data.Fields["engine"], data.Fields["category"]
+
+	if d, ok := item.(Dated); ok && !d.GetDate().IsZero() {
+		data.Date = d.GetDate()
+		data.Year = data.Date.Format("2006")
+	}
+	return data, nil
+}
+
+// linkID returns the id parameter of a download link, e.g. of ccan-dl.pl?id=12 or download.php?dl=12,
+// or a short hash of the link if it has none
+func linkID(link string) string {
+	if u, err := url.Parse(link); err == nil {
+		for _, param := range []string{"id", "dl"} {
+			if id := u.Query().Get(param); id != "" {
+				return id
+			}
+		}
+	}
+	return nameHash(link)
+}
+
+// OutputPath executes the text/template of the path of the archive. It has access to the current date as {{.Date}}
+// (YYYY-MM-DD), the time as {{.Time}} (HH-MM-SS, other layouts with {{.Time.Format "15.04"}}), the format as {{.Format}}
+// and the extension for it, including the dot, as {{.Ext}}
+func OutputPath(text string, format Format) (string, error) {
+	tmpl, err := template.New("output").Parse(text)
+	if err != nil {
+		return "", err
+	}
+
+	var (
+		now = time.Now().Round(0) // without monotonic clock reading
+		ext string
+		buf bytes.Buffer
+	)
+	if format != FormatDir {
+		ext = "." + string(format)
+	}
+	err = tmpl.Execute(&buf, struct {
+		Date, Format, Ext string
+		Time              outputTime
+	}{now.Format("2006-01-02"), string(format), ext, outputTime{now}})
+	if err != nil {
+		return "", err
+	}
+	if buf.Len() == 0 {
+		return "", fmt.Errorf("output path %q is empty", text)
+	}
+	return buf.String(), nil
+}
+
+// outputTime is printed as 15-04-05 in output paths, as colons are not allowed in file names on Windows
+type outputTime struct {
+	time.Time
+}
+
+func (t outputTime) String() string {
+	return t.Format("15-04-05")
+}
@@ -0,0 +1,172 @@
+package zipfactory
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Paths are limited in bytes, so archives can be extracted on every OS. Windows only supports 260 characters by default;
+// some of them are taken by the directory the archive is extracted to, the suffixes added by uniquePath and ".json"
+const (
+	maxComponentLength = 100
+	maxPathLength      = 200
+)
+
+var allowedChars = "ABCDEFGHIJKLMNOPQRSTUVWXYZ" + "abcdefghijklmnopqrstuvwxyz" + "0123456789" + " -_.,()[]+" + "ÄÖÜßäöü"
+
+func isAllowedChar(char rune) (contains bool) {
+	for _, r := range allowedChars {
+		if r == char {
+			return true
+		}
+	}
+	return false
+}
+
+// transliterations replace characters that are not allowed by similar ones that are
+var transliterations = buildTransliterations(map[string]string{
+	"ÀÁÂÃÅĀĂĄ": "A", "àáâãåāăą": "a", "Æ": "AE", "æ": "ae",
+	"ÇĆĈĊČ": "C", "çćĉċč": "c", "ĎĐÐ": "D", "ďđð": "d",
+	"ÈÉÊËĒĔĖĘĚ": "E", "èéêëēĕėęě": "e", "ĜĞĠĢ": "G", "ĝğġģ": "g",
+	"ĤĦ": "H", "ĥħ": "h", "ÌÍÎÏĨĪĬĮİ": "I", "ìíîïĩīĭįı": "i",
+	"Ĵ": "J", "ĵ": "j", "Ķ": "K", "ķ": "k", "ĹĻĽĿŁ": "L", "ĺļľŀł": "l",
+	"ÑŃŅŇ": "N", "ñńņňŉ": "n", "ÒÓÔÕØŌŎŐ": "O", "òóôõøōŏő": "o", "Œ": "OE", "œ": "oe",
+	"ŔŖŘ": "R", "ŕŗř": "r", "ŚŜŞŠ": "S", "śŝşš": "s", "ŢŤŦ": "T", "ţťŧ": "t",
+	"Þ": "TH", "þ": "th", "ÙÚÛŨŪŬŮŰŲ": "U", "ùúûũūŭůűų": "u", "Ŵ": "W", "ŵ": "w",
+	"ÝŶŸ": "Y", "ýÿŷ": "y", "ŹŻŽ": "Z", "źżž": "z",
+
+	"А": "A", "а": "a", "Б": "B", "б": "b", "В": "V", "в": "v", "Г": "G", "г": "g", "Д": "D", "д": "d",
+	"ЕЁЭ": "E", "еёэ": "e", "Ж": "Zh", "ж": "zh", "З": "Z", "з": "z", "И": "I", "и": "i", "ЙЫ": "Y", "йы": "y",
+	"К": "K", "к": "k", "Л": "L", "л": "l", "М": "M", "м": "m", "Н": "N", "н": "n", "О": "O", "о": "o",
+	"П": "P", "п": "p", "Р": "R", "р": "r", "С": "S", "с": "s", "Т": "T", "т": "t", "У": "U", "у": "u",
+	"Ф": "F", "ф": "f", "Х": "Kh", "х": "kh", "Ц": "Ts", "ц": "ts", "Ч": "Ch", "ч": "ch", "Ш": "Sh", "ш": "sh",
+	"Щ": "Shch", "щ": "shch", "ЪЬъь": "", "Ю": "Yu", "ю": "yu", "Я": "Ya", "я": "ya",
+	"–—": "-",
+})
+
+func buildTransliterations(groups map[string]string) map[rune]string {
+	var t = make(map[rune]string)
+	for chars, replacement := range groups {
+		for _, r := range chars {
+			t[r] = replacement
+		}
+	}
+	return t
+}
+
+// windowsReservedNames cannot be used as file names on Windows, not even with an extension
+var windowsReservedNames = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true, "COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true, "LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// cleanFilename returns a file or folder name for in that works on every OS. Characters that are not allowed are
+// transliterated or dropped. If nothing readable is left, a hash of in is used, so the name is still stable
+func cleanFilename(in string) (out string) {
+	var b = strings.Builder{}
+
+	for _, item := range in {
+		switch t, ok := transliterations[item]; {
+		case isAllowedChar(item):
+			b.WriteRune(item)
+		case ok:
+			b.WriteString(t)
+		case unicode.IsSpace(item):
+			b.WriteRune(' ')
+		}
+	}
+
+	out = truncate(trimName(b.String()), maxComponentLength)
+	if !strings.ContainsAny(strings.ToLower(out), "abcdefghijklmnopqrstuvwxyz0123456789äöüß") {
+		return nameHash(in)
+	}
+
+	// Windows ignores everything after the first dot, so "con.c4d" is reserved too
+	if base := strings.SplitN(out, ".", 2); windowsReservedNames[strings.ToUpper(strings.TrimSpace(base[0]))] {
+		base[0] += "_"
+		out = strings.Join(base, ".")
+	}
+	return out
+}
+
+// trimName removes spaces and dots from the beginning and end of a name. Windows drops them at the end, and names
+// like ".." or ".hidden" would be special on most systems
+func trimName(name string) string {
+	return strings.Trim(name, " .")
+}
+
+// truncate shortens s to at most max bytes without splitting characters
+func truncate(s string, max int) string {
+	if max < 0 {
+		max = 0
+	}
+	if len(s) <= max {
+		return s
+	}
+	for max > 0 && !utf8.RuneStart(s[max]) {
+		max--
+	}
+	return trimName(s[:max])
+}
+
+// shorten truncates the cleaned name to max bytes. If nothing is left, a hash of the original name is used
+func shorten(cleaned, original string, max int) string {
+	if len(cleaned) <= max {
+		return cleaned
+	}
+	if s := truncate(cleaned, max); s != "" {
+		return s
+	}
+	return truncate(nameHash(original), max)
+}
+
+// nameHash returns a stable name for in that consists of hex digits
+func nameHash(in string) string {
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(in)))[:12]
+}
+
+// itemPath joins the cleaned components with slashes, so the path is not longer than maxPathLength once ext is added.
+// The last one is shortened first; if the folders take up more than half of the path, they are shortened to that.
+// ext is not part of the returned path
+func itemPath(ext string, components ...string) string {
+	var cleaned = make([]string, len(components))
+	for i, c := range components {
+		cleaned[i] = cleanFilename(c)
+	}
+
+	var (
+		last      = len(cleaned) - 1
+		available = maxPathLength
+	)
+	if ext != "" {
+		available -= len("." + ext)
+	}
+
+	if folders := len(strings.Join(cleaned[:last], "/")); last > 0 && folders > available/2 && folders+len("/")+len(cleaned[last]) > available {
+		// Every folder gets the same share, at least one character
+		share := (available/2 - (last - 1)) / last
+		if share < 1 {
+			share = 1
+		}
+		for i := 0; i < last; i++ {
+			cleaned[i] = shorten(cleaned[i], components[i], share)
+		}
+	}
+
+	rest := len(strings.Join(cleaned[:last], "/"))
+	if last > 0 {
+		rest += len("/")
+	}
+	// Only a path with lots of folders can leave less, it will be too long anyway
+	nameLength := available - rest
+	if nameLength < len(nameHash("")) {
+		nameLength = len(nameHash(""))
+	}
+	cleaned[last] = shorten(cleaned[last], components[last], nameLength)
+
+	return strings.Join(cleaned, "/")
+}
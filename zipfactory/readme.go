@@ -3,6 +3,7 @@ package zipfactory
 //go:generate go-bindata -pkg zipfactory -o readme_template.go README.md.tmpl
 
 import (
+	"fmt"
 	"io"
 	"text/template"
 	"time"
@@ -12,14 +13,49 @@ const (
 	readmeOutputDateFormat = "January 02, 2006"
 )
 
+// ReadmeInfo contains the statistics that are shown in the README
+type ReadmeInfo struct {
+	Count         int64
+	FailedEntrys  int64
+	SkippedEntrys int64
+
+	// Interrupted should be set if the archive is incomplete because the run was stopped
+	Interrupted bool
+
+	// ExtraFiles are the names of additional files in the root of the archive
+	ExtraFiles []string
+
+	// Duplicates is the number of items whose file is the same as the one of another item, so it is only stored once.
+	// SavedBytes is the size of all their files
+	Duplicates int64
+	SavedBytes int64
+
+	// Quarantined is the number of downloads that looked like error pages instead of the expected file
+	Quarantined int64
+}
+
 type readmeData struct {
-	Count        int64
-	DateString   string
-	FailedEntrys int64
+	ReadmeInfo
+	DateString string
+	SavedSize  string
+}
+
+// formatSize formats a number of bytes for humans
+func formatSize(bytes int64) string {
+	const unit = 1024
+	if bytes < unit {
+		return fmt.Sprintf("%d bytes", bytes)
+	}
+	div, exp := int64(unit), 0
+	for n := bytes / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(bytes)/float64(div), "KMGTPE"[exp])
 }
 
 // GenerateReadme Writes the README file to `w`
-func GenerateReadme(w io.Writer, itemCount, numFailedEntrys int64) {
+func GenerateReadme(w io.Writer, info ReadmeInfo) {
 	readme, err := readmeMdTmplBytes()
 	if err != nil {
 		panic(err)
@@ -33,9 +69,9 @@ func GenerateReadme(w io.Writer, itemCount, numFailedEntrys int64) {
 	ds := time.Now().Format(readmeOutputDateFormat)
 
 	if err := tmpl.Execute(w, readmeData{
-		Count:        itemCount,
-		DateString:   ds,
-		FailedEntrys: numFailedEntrys,
+		ReadmeInfo: info,
+		DateString: ds,
+		SavedSize:  formatSize(info.SavedBytes),
 	}); err != nil {
 		panic(err)
 	}
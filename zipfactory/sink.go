@@ -0,0 +1,143 @@
+package zipfactory
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Sink receives the entries of an archive. All methods are called from a single goroutine
+type Sink interface {
+	// CreateEntry writes the downloaded file of an item. Its size and CRC-32 checksum are known in advance
+	CreateEntry(name string, content io.Reader, size int64, crc uint32) error
+
+	// WriteMetadata writes a generated file, e.g. the metadata of an item or the README
+	WriteMetadata(name string, content []byte) error
+
+	// Finalize completes the archive and releases all resources. It is called exactly once, even if writing failed
+	Finalize() error
+}
+
+// journaledSink is implemented by sinks whose entries can be recorded in a journal, so an interrupted archive can be continued
+type journaledSink interface {
+	Sink
+
+	// checkpoint returns the entries written since the last checkpoint and the position after them.
+	// If sync is set, everything written so far is on disk when it returns
+	checkpoint(sync bool) (entries []journalEntry, end int64, err error)
+
+	// recover restores the entries of items that were recorded in a journal and removes everything written after them
+	recover(items []journalItem) error
+}
+
+// Format is the kind of archive that is written
+type Format string
+
+// The supported formats. Directories contain the same files as archives
+const (
+	FormatZip    Format = "zip"
+	FormatDir    Format = "dir"
+	FormatTar    Format = "tar"
+	FormatTarGz  Format = "tar.gz"
+	FormatTarZst Format = "tar.zst"
+
+	// FormatNone discards everything, e.g. because the files are only needed in a WARC file
+	FormatNone Format = "none"
+)
+
+// Formats are all supported formats
+var Formats = []Format{FormatZip, FormatDir, FormatTar, FormatTarGz, FormatTarZst, FormatNone}
+
+// ParseFormat returns the format with the given name
+func ParseFormat(name string) (Format, error) {
+	for _, f := range Formats {
+		if string(f) == strings.ToLower(name) {
+			return f, nil
+		}
+	}
+	return "", fmt.Errorf("unknown archive format %q", name)
+}
+
+// Resumable returns whether archives of this format can be recorded in a journal and continued after an interruption
+func (f Format) Resumable() bool {
+	return f == FormatZip || f == FormatDir
+}
+
+// FormatFilename returns the name of the archive for today
+func FormatFilename(format Format) string {
+	name, _ := OutputPath(DefaultOutput, format)
+	return name
+}
+
+// OpenSink creates an archive at path. Tar streams can be written to the standard output by passing "-" as path.
+// If resume is set, an existing zip file or directory is opened instead, see Options.Resume
+func OpenSink(format Format, path string, resume bool) (Sink, error) {
+	if resume && !format.Resumable() {
+		return nil, fmt.Errorf("%s archives cannot be resumed", format)
+	}
+	if format == FormatNone {
+		return discardSink{}, nil
+	}
+	if path == "-" {
+		switch format {
+		case FormatTar, FormatTarGz, FormatTarZst:
+			return newTarSink(os.Stdout, format)
+		}
+		return nil, fmt.Errorf("%s archives cannot be written to the standard output", format)
+	}
+
+	// Templates for the path may put archives into a new folder
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+
+	switch format {
+	case FormatZip:
+		var (
+			f   *os.File
+			err error
+		)
+		if resume {
+			f, err = os.OpenFile(path, os.O_RDWR, 0)
+		} else {
+			f, err = os.Create(path)
+		}
+		if err != nil {
+			return nil, err
+		}
+		return newZipSink(f), nil
+	case FormatDir:
+		if err := os.MkdirAll(path, 0755); err != nil {
+			return nil, err
+		}
+		return &dirSink{dir: path}, nil
+	case FormatTar, FormatTarGz, FormatTarZst:
+		f, err := os.Create(path)
+		if err != nil {
+			return nil, err
+		}
+		s, err := newTarSink(f, format)
+		if err != nil {
+			f.Close()
+		}
+		return s, err
+	}
+	return nil, fmt.Errorf("unknown archive format %q", format)
+}
+
+// discardSink drops all entries
+type discardSink struct{}
+
+func (discardSink) CreateEntry(name string, content io.Reader, size int64, crc uint32) error {
+	return nil
+}
+
+func (discardSink) WriteMetadata(name string, content []byte) error {
+	return nil
+}
+
+func (discardSink) Finalize() error {
+	return nil
+}
@@ -0,0 +1,186 @@
+package zipfactory
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+// readArchive returns the content of all files in the archive at path by their name
+func readArchive(t *testing.T, format Format, path string) map[string]string {
+	var files = make(map[string]string)
+
+	switch format {
+	case FormatZip:
+		r, err := zip.OpenReader(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer r.Close()
+		for _, f := range r.File {
+			rc, err := f.Open()
+			if err != nil {
+				t.Fatal(err)
+			}
+			content, _ := ioutil.ReadAll(rc)
+			rc.Close()
+			files[f.Name] = string(content)
+		}
+	case FormatDir:
+		err := filepath.Walk(path, func(p string, info os.FileInfo, err error) error {
+			if err != nil || info.IsDir() {
+				return err
+			}
+			content, err := ioutil.ReadFile(p)
+			rel, _ := filepath.Rel(path, p)
+			files[filepath.ToSlash(rel)] = string(content)
+			return err
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	default:
+		raw, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var r io.Reader = bytes.NewReader(raw)
+		switch format {
+		case FormatTarGz:
+			if r, err = gzip.NewReader(r); err != nil {
+				t.Fatal(err)
+			}
+		case FormatTarZst:
+			cmd := exec.Command("zstd", "-d", "-c")
+			cmd.Stdin = r
+			out, err := cmd.Output()
+			if err != nil {
+				t.Fatal(err)
+			}
+			r = bytes.NewReader(out)
+		}
+
+		tr := tar.NewReader(r)
+		for {
+			h, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			content, _ := ioutil.ReadAll(tr)
+			files[h.Name] = string(content)
+		}
+	}
+
+	return files
+}
+
+func TestSinks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "zipfactory-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, format := range Formats {
+		if format == FormatNone {
+			continue
+		}
+		if _, err := exec.LookPath("zstd"); err != nil && format == FormatTarZst {
+			t.Logf("Skipping %s: %s", format, err.Error())
+			continue
+		}
+
+		// The folder of the archive is created if it doesn't exist
+		path := filepath.Join(dir, "mirror", FormatFilename(format))
+		sink, err := OpenSink(format, path, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = CreateZipFileFromItems(context.Background(), testItems(3), Options{Sink: sink, Fetcher: &testFetcher{}})
+		if err != nil {
+			t.Fatalf("%s: %s", format, err.Error())
+		}
+
+		files := readArchive(t, format, path)
+		for i := 0; i < 3; i++ {
+			name := fmt.Sprintf("Test/author/httpsexample.com%d.c4d.c4d", i)
+			if link := fmt.Sprintf("https://example.com/%d.c4d", i); files[name] != link {
+				t.Errorf("%s: expected %s to contain %q, got %q", format, name, link, files[name])
+			}
+			if _, ok := files[name+".json"]; !ok {
+				t.Errorf("%s: metadata of %s is missing", format, name)
+			}
+		}
+		if _, ok := files["README.md"]; !ok || len(files) != 7 {
+			t.Errorf("%s: expected 3 items with metadata and a README, got %d files", format, len(files))
+		}
+	}
+}
+
+func TestResumeDirectory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "zipfactory-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "archive")
+	journal, err := CreateJournal(JournalPath(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink, err := OpenSink(FormatDir, path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = CreateZipFileFromItems(context.Background(), testItems(2), Options{Sink: sink, Journal: journal, Fetcher: &testFetcher{}}); err != nil {
+		t.Fatal(err)
+	}
+	if err = journal.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Simulate a crash while writing a file
+	partial := filepath.Join(path, "Test", "author", "httpsexample.com2.c4d.c4d"+partialSuffix)
+	if err = ioutil.WriteFile(partial, []byte("partial"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if journal, err = OpenJournal(JournalPath(path)); err != nil {
+		t.Fatal(err)
+	}
+	if sink, err = OpenSink(FormatDir, path, true); err != nil {
+		t.Fatal(err)
+	}
+	var fetcher = &testFetcher{}
+	if err = CreateZipFileFromItems(context.Background(), testItems(3), Options{Sink: sink, Journal: journal, Resume: true, Fetcher: fetcher}); err != nil {
+		t.Fatal(err)
+	}
+	journal.Close()
+
+	if len(fetcher.requested) != 1 {
+		t.Errorf("expected only the new item to be downloaded, but got %v", fetcher.requested)
+	}
+	if _, err = os.Stat(partial); !os.IsNotExist(err) {
+		t.Errorf("the partial file was not removed")
+	}
+	if files := readArchive(t, FormatDir, path); len(files) != 7 {
+		t.Errorf("expected 3 items with metadata and a README, got %d files", len(files))
+	}
+
+	if _, err = OpenSink(FormatTarGz, filepath.Join(dir, "archive.tar.gz"), true); err == nil {
+		t.Errorf("expected tar streams not to be resumable")
+	}
+}
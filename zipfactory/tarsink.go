@@ -0,0 +1,99 @@
+package zipfactory
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os/exec"
+	"time"
+)
+
+// tarSink writes a tar stream, optionally compressed. Streams cannot be continued after an interruption,
+// so it is not a journaledSink
+type tarSink struct {
+	out io.WriteCloser
+	w   *tar.Writer
+
+	// compressor sits between w and out, it is nil for plain tar files
+	compressor io.WriteCloser
+	// wait waits for an external compressor to exit, it is nil if none is used
+	wait func() error
+
+	// modTime is the modification time of all entries
+	modTime time.Time
+}
+
+// newTarSink writes to out, which is closed by Finalize. There is no zstd implementation in the standard library,
+// so tar.zst streams are compressed by the zstd command, which must be installed
+func newTarSink(out io.WriteCloser, format Format) (*tarSink, error) {
+	var t = &tarSink{out: out, modTime: time.Now().Truncate(time.Second)}
+
+	switch format {
+	case FormatTar:
+		t.w = tar.NewWriter(out)
+	case FormatTarGz:
+		t.compressor = gzip.NewWriter(out)
+		t.w = tar.NewWriter(t.compressor)
+	case FormatTarZst:
+		cmd := exec.Command("zstd", "-q", "-c")
+		cmd.Stdout = out
+		stdin, err := cmd.StdinPipe()
+		if err != nil {
+			return nil, err
+		}
+		if err = cmd.Start(); err != nil {
+			return nil, fmt.Errorf("tar.zst archives need the zstd command: %w", err)
+		}
+		t.compressor, t.wait = stdin, cmd.Wait
+		t.w = tar.NewWriter(stdin)
+	default:
+		return nil, fmt.Errorf("%s is not a tar format", format)
+	}
+
+	return t, nil
+}
+
+// CreateEntry implements Sink
+func (t *tarSink) CreateEntry(name string, content io.Reader, size int64, crc uint32) error {
+	err := t.w.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Size:     size,
+		Mode:     0644,
+		ModTime:  t.modTime,
+	})
+	if err != nil {
+		return fmt.Errorf("while creating file %s: %w", name, err)
+	}
+	if _, err = io.CopyN(t.w, content, size); err != nil {
+		return fmt.Errorf("while copying %s to archive: %w", name, err)
+	}
+	return nil
+}
+
+// WriteMetadata implements Sink
+func (t *tarSink) WriteMetadata(name string, content []byte) error {
+	return t.CreateEntry(name, bytes.NewReader(content), int64(len(content)), 0)
+}
+
+// Finalize implements Sink. It writes the end of the tar stream and waits until it has been compressed completely
+func (t *tarSink) Finalize() error {
+	var errs []error
+	errs = append(errs, t.w.Close())
+	if t.compressor != nil {
+		errs = append(errs, t.compressor.Close())
+	}
+	if t.wait != nil {
+		errs = append(errs, t.wait())
+	}
+	errs = append(errs, t.out.Close())
+
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
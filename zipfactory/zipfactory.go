@@ -1,14 +1,13 @@
 package zipfactory
 
 import (
-	"archive/zip"
+	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
-	"os"
-	"path"
-	"strings"
+	"sort"
 	"time"
 )
 
@@ -19,187 +18,325 @@ type Archivable interface {
 	GetSourceName() string
 }
 
+// Verifiable is implemented by items whose file has a known checksum. Downloads that don't match it are rejected
+type Verifiable interface {
+	// GetSHA256 returns the hex encoded SHA-256 checksum of the file, or an empty string if it is unknown
+	GetSHA256() string
+}
+
+// Dated is implemented by items that know when they were uploaded. The date is used to tell items with the same name apart
+type Dated interface {
+	// GetDate returns the upload date, or the zero time if it is unknown
+	GetDate() time.Time
+}
+
+// Stored is implemented by items whose file is read from somewhere else instead of being downloaded, e.g. from an earlier archive
+type Stored interface {
+	// OpenStored opens the file. name is its original file name, it is used instead of the download URL to determine the extension
+	OpenStored() (rc io.ReadCloser, name string, err error)
+}
+
+// QuarantineDir is the folder in the archive that contains downloads that look like error pages instead of the expected file
+const QuarantineDir = "quarantine"
+
 type createError struct {
 	Error    string     `json:"error_message"`
 	Metadata Archivable `json:"item"`
 }
 
-var (
-	downloaded   = make(map[string]bool)
-	failedEntrys = []createError{}
-)
+// archive is an archive that is being written. It is only used by a single goroutine
+type archive struct {
+	sink Sink
+
+	// journal is nil if the progress is not recorded
+	journal *Journal
+
+	// blobs maps the SHA-256 checksums of all files in the archive to their path. It is nil if files are not deduplicated
+	blobs      map[string]string
+	duplicates int64
+	savedBytes int64
+
+	// layout decides the paths of items
+	layout *Layout
+
+	// paths contains the lower case names of all entries, so no two items end up with the same path
+	paths map[string]bool
 
-func appendPrintError(what string, err error, item Archivable) {
+	failedEntrys []createError
+	itemCount    int64
+	quarantined  int64
+}
+
+func (a *archive) appendPrintError(what string, err error, item Archivable) {
 	errMessage := fmt.Sprintf("%s: %s", what, err.Error())
 	fmt.Printf(" > Error %s\n", errMessage)
-	failedEntrys = append(failedEntrys, createError{
+	a.failedEntrys = append(a.failedEntrys, createError{
 		Error:    errMessage,
 		Metadata: item,
 	})
 }
 
-func formatFilename() string {
-	return time.Now().Format("CCAN-Clonk-Center-Archiv-2006-01-02.zip")
+// Fetcher downloads files. It is implemented by *crawler.Fetcher
+type Fetcher interface {
+	// Get requests url and returns the response if it was successful
+	Get(ctx context.Context, url string) (*http.Response, error)
 }
 
-// CreateZipFileFromItems streams the items in input to a zip file called 'result.zip'
-func CreateZipFileFromItems(input chan Archivable) error {
-	// Create Zip
-	f, err := os.Create(formatFilename())
+// httpFetcher is a Fetcher using http.DefaultClient
+type httpFetcher struct{}
+
+func (httpFetcher) Get(ctx context.Context, url string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err == nil && (resp.StatusCode < 200 || resp.StatusCode > 399) {
+		resp.Body.Close()
+		return nil, fmt.Errorf("Error in http request: StatusCode is %d", resp.StatusCode)
 	}
-	defer f.Close()
+	return resp, err
+}
 
-	w := zip.NewWriter(f)
-	defer w.Close()
+// Options configures how an archive is created
+type Options struct {
+	// Fetcher is used to download all files. If it is nil, http.DefaultClient is used
+	Fetcher Fetcher
 
-	// This holds the current direct url to a file
-	var currentDirectURL string
+	// Skipped is called after all items have been archived. The returned entries, e.g. listing rows
+	// that were dropped by a crawler, are written to skipped.json
+	Skipped func() []interface{}
 
-	// Create http client
-	var client = http.Client{
-		Timeout: 30 * time.Minute, // long timeout as downloads can be big
-	}
+	// Extra is called after all items have been archived. Every value in the returned map is written as json
+	// to a file in the root of the archive, using its key as file name
+	Extra func() map[string]interface{}
 
-	// If we get redirected, we set the direct url
-	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
-		currentDirectURL = req.URL.String()
-		return nil
-	}
+	// Downloaders is the number of files that are downloaded at the same time, at least one
+	Downloaders int
 
-	var itemCount int64 = 1
+	// SpoolBudget limits the disk space in bytes that downloaded files waiting to be written to the archive may take up.
+	// 0 means no limit. The file the archive is waiting for may always exceed it
+	SpoolBudget int64
 
-	// Loop over channel & Download & Pack
-	for item := range input {
-		// Check if we already this item or there is no download link
-		if _, contains := downloaded[item.GetDownloadLink()]; item.GetDownloadLink() == "" || contains {
-			println("Already have", item.GetDownloadLink())
-			continue
-		}
-		// Set default value
-		currentDirectURL = item.GetDownloadLink()
+	// TempDir is the directory downloads are spooled to. If it is empty, the default directory for temporary files is used
+	TempDir string
 
-		var resp, err = client.Get(item.GetDownloadLink())
-		if err != nil {
-			appendPrintError("while downloading item", err, item)
-			continue
-		}
+	// Sink receives all entries of the archive. If it is nil, a zip file is written to Path
+	Sink Sink
 
-		// Generate name and show user
-		name := fmt.Sprintf("%s/%s/%s.%s", item.GetSourceName(), cleanFilename(item.GetAuthor()), cleanFilename(item.GetName()), getURLExtension(currentDirectURL))
-		fmt.Printf("Downloading %s (#%d)", name, itemCount)
+	// Path is the zip file the archive is written to if there is no Sink. If it is empty, FormatFilename(FormatZip) is used
+	Path string
 
-		// Create in zip file
-		f, err := w.Create(name)
-		if err != nil {
-			appendPrintError("while creating file", err, item)
-			continue
-		}
+	// Journal records every archived item, so the run can be resumed if it is interrupted
+	Journal *Journal
 
-		// Copy to zip file
-		if _, err = io.Copy(f, resp.Body); err != nil {
-			appendPrintError("while copying file stream to archive", err, item)
-			continue
-		}
+	// Layout decides the path of every item in the archive. If it is nil, DefaultLayout is used
+	Layout *Layout
 
-		if err = w.Flush(); err != nil {
-			appendPrintError("while flushing downloaded file", err, item)
-			continue
-		}
+	// Dedup stores files with the same content only once. The metadata of all items points to the path of their file
+	Dedup bool
 
-		// Write info json
-		infoName := fmt.Sprintf("%s.json", name)
-		result, err := json.MarshalIndent(item, "", "    ")
-		if err != nil {
-			appendPrintError("while generating json data", err, item)
-			continue
-		}
+	// Resume continues the archive instead of overwriting it. All items recorded in Journal are kept
+	// and not downloaded again, everything after them is removed. The Sink must have been opened for resuming, see OpenSink
+	Resume bool
+}
 
-		fj, err := w.Create(infoName)
-		if err != nil {
-			appendPrintError("while creating json file", err, item)
-			continue
+// CreateZipFileFromItems streams the items in input to opts.Sink, or the zip file at opts.Path.
+// Files are downloaded by opts.Downloaders workers at the same time, but always written to the archive in input order.
+// If ctx is done, downloads that are still running are dropped and the archive is finalized with all items
+// that were completed until then. In that case, ctx.Err() is returned after the archive has been written successfully
+func CreateZipFileFromItems(ctx context.Context, input <-chan Archivable, opts Options) (err error) {
+	var fetcher = opts.Fetcher
+	if fetcher == nil {
+		fetcher = httpFetcher{}
+	}
+
+	var sink = opts.Sink
+	if sink == nil {
+		var path = opts.Path
+		if path == "" {
+			path = FormatFilename(FormatZip)
 		}
+		if sink, err = OpenSink(FormatZip, path, opts.Resume); err != nil {
+			return err
+		}
+	}
+	defer func() {
+		if ferr := sink.Finalize(); err == nil {
+			err = ferr
+		}
+		if err == nil {
+			err = ctx.Err()
+		}
+	}()
 
-		_, err = fj.Write(result)
-		if err != nil {
-			appendPrintError("while writing json file", err, item)
-			continue
+	var layout = opts.Layout
+	if layout == nil {
+		if layout, err = ParseLayout(DefaultLayout); err != nil {
+			return err
 		}
+	}
+
+	a := newArchive(sink, opts.Journal, layout)
+	if opts.Dedup {
+		a.blobs = make(map[string]string)
+	}
 
-		if err = w.Flush(); err != nil {
-			appendPrintError("while flushing json file", err, item)
-			continue
+	var archived map[string]bool
+	if opts.Resume {
+		if opts.Journal == nil {
+			return fmt.Errorf("cannot resume without a journal")
 		}
+		if err = a.recover(); err != nil {
+			return fmt.Errorf("cannot resume: %w", err)
+		}
+		archived = opts.Journal.archived
+		fmt.Printf("Recovered %d items\n", a.itemCount-1)
+	}
 
-		// add the current link to the links we already downloaded
-		downloaded[item.GetDownloadLink()] = true
+	// Download & Pack
+	err = downloadAll(ctx, input, fetcher, opts, archived, func(d *download) error {
+		return a.add(ctx, d)
+	})
+	if err != nil {
+		return err
+	}
+
+	var skipped []interface{}
+	if opts.Skipped != nil {
+		skipped = opts.Skipped()
+	}
 
-		// Reset the url so the check above won't generate unexpected results
-		currentDirectURL = ""
+	failedEntrys := a.failedEntrys
 
-		println(" > Success")
-		itemCount++
+	var extra map[string]interface{}
+	if opts.Extra != nil {
+		extra = opts.Extra()
 	}
+	var extraNames []string
+	for name := range extra {
+		extraNames = append(extraNames, name)
+	}
+	sort.Strings(extraNames)
 
 	// Generate a README.md file
-	rm, err := w.Create("README.md")
-	if err != nil {
+	var readme bytes.Buffer
+	GenerateReadme(&readme, ReadmeInfo{
+		Count:         a.itemCount,
+		FailedEntrys:  int64(len(failedEntrys)),
+		SkippedEntrys: int64(len(skipped)),
+		Interrupted:   ctx.Err() != nil,
+		ExtraFiles:    extraNames,
+		Duplicates:    a.duplicates,
+		SavedBytes:    a.savedBytes,
+		Quarantined:   a.quarantined,
+	})
+	if err = sink.WriteMetadata("README.md", readme.Bytes()); err != nil {
 		return err
 	}
-	GenerateReadme(rm, itemCount, int64(len(failedEntrys)))
 	println("\nGenerated README.")
 
-	if len(failedEntrys) > 0 {
-		ff, err := w.Create("failed.json")
+	var writeJSON = func(name string, content interface{}) error {
+		byt, err := json.MarshalIndent(content, "", "    ")
 		if err != nil {
 			return err
 		}
-		byt, err := json.MarshalIndent(&failedEntrys, "", "    ")
-		if err != nil {
+		return sink.WriteMetadata(name, byt)
+	}
+
+	for _, name := range extraNames {
+		if err = writeJSON(name, extra[name]); err != nil {
 			return err
 		}
-		ff.Write(byt)
 	}
 
-	if err = w.Flush(); err != nil {
-		return err
+	if len(skipped) > 0 {
+		if err = writeJSON("skipped.json", skipped); err != nil {
+			return err
+		}
+	}
+
+	if len(failedEntrys) > 0 {
+		if err = writeJSON("failed.json", failedEntrys); err != nil {
+			return err
+		}
 	}
 
 	return nil
 }
 
-func getURLExtension(url string) string {
-	ext := path.Ext(url)
-	if len(ext) == 0 {
-		return ""
+// add writes a finished download and its metadata to the archive. Downloads that failed are recorded in failed.json.
+// Errors are only returned if writing to the archive failed, as the archive is unusable after that
+func (a *archive) add(ctx context.Context, d *download) error {
+	item := d.item
+	if d.err != nil {
+		// Downloads that were cancelled aren't failures
+		if ctx.Err() == nil {
+			fmt.Printf("Downloading %s", item.GetDownloadLink())
+			a.appendPrintError(d.what, d.err, item)
+		}
+		return nil
 	}
-	return ext[1:]
-}
-
-var allowedChars = "ABCDEFGHIJKLMNOPQRSTUVWXYZ" + "abcdefghijklmnopqrstuvwxyz" + "0123456789" + " -_.,()[]+" + "ÄÖÜßäöü"
 
-func isAllowedChar(char rune) (contains bool) {
-	for _, r := range allowedChars {
-		if r == char {
-			return true
+	// Generate name and show user. Files that look like error pages are kept separately
+	components, err := a.layout.components(item)
+	if err != nil {
+		fmt.Printf("Archiving %s", item.GetDownloadLink())
+		a.appendPrintError("while generating the path", err, item)
+		return nil
+	}
+	var ext = d.ext
+	if d.quarantine != "" {
+		components, ext = append([]string{QuarantineDir}, components...), d.quarantineExt
+	}
+	name := a.uniquePath(item, itemPath(ext, components...), ext)
+	fmt.Printf("Downloading %s (#%d)", name, a.itemCount)
+
+	var (
+		file      = fileInfo{Path: name, Size: d.spool.size, SHA256: d.spool.sha256, OriginalName: d.serverName, Quarantine: d.quarantine}
+		duplicate bool
+	)
+	if a.blobs != nil && file.Quarantine == "" {
+		if existing, ok := a.blobs[file.SHA256]; ok {
+			file.Path, duplicate = existing, true
 		}
 	}
-	return false
-}
 
-func cleanFilename(in string) (out string) {
-	var b = strings.Builder{}
+	// Generate the metadata first, so nothing is written if it fails
+	result, err := itemMetadata(item, file)
+	if err != nil {
+		a.appendPrintError("while generating json data", err, item)
+		return nil
+	}
 
-	for _, item := range in {
-		if isAllowedChar(item) {
-			_, err := b.WriteRune(item)
-			if err != nil {
-				panic(err) // This should never happen
-			}
+	if !duplicate {
+		// The file has been verified, so it can be copied to the archive as a whole
+		if err = a.sink.CreateEntry(name, d.spool, d.spool.size, d.spool.crc32); err != nil {
+			return err
 		}
 	}
 
-	return b.String()
+	// Write info json
+	if err = a.sink.WriteMetadata(fmt.Sprintf("%s.json", name), result); err != nil {
+		return err
+	}
+
+	if err = a.commit(item.GetDownloadLink(), file); err != nil {
+		return err
+	}
+	a.addBlob(file)
+
+	if file.Quarantine != "" {
+		fmt.Printf(" > Quarantined: %s\n", file.Quarantine)
+		a.quarantined++
+		return nil
+	}
+	if duplicate {
+		fmt.Printf(" > Same file as %s\n", file.Path)
+		a.itemCount++
+		return nil
+	}
+	println(" > Success")
+	a.itemCount++
+	return nil
 }
@@ -1,11 +1,29 @@
 package zipfactory
 
-import "testing"
+import (
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
 
 func TestGenerateFilename(t *testing.T) {
 
 	table := map[string]string{
-		"https://www.clonkx.de/endeavour/Freeware.c4k": "c4k",
+		"https://www.clonkx.de/endeavour/Freeware.c4k":           "c4k",
+		"https://ccan.de/cgi-bin/ccan/ccan-dl.pl?id=12&ext=.c4s": "",
+		"https://example.com/files/Melee.c4s?version=2":          "c4s",
+		"https://example.com/files/":                             "",
+		"https://example.com/download.php":                       "",
 	}
 
 	for key, value := range table {
@@ -15,3 +33,198 @@ func TestGenerateFilename(t *testing.T) {
 		}
 	}
 }
+
+func TestServerFilename(t *testing.T) {
+	table := []struct {
+		disposition, url, expected string
+	}{
+		{`attachment; filename="Hazard.c4d"`, "https://ccan.de/cgi-bin/ccan/ccan-dl.pl?id=1", "Hazard.c4d"},
+		{`attachment; filename*=UTF-8''M%C3%BChle.c4s`, "https://example.com/dl.php", "Mühle.c4s"},
+		{`attachment; filename="C:\Clonk\Western.c4f"`, "", "Western.c4f"},
+		{"", "https://example.com/files/Gold%20Rush.c4s?x=1", "Gold Rush.c4s"},
+		{"", "https://example.com/download.pl?id=3", ""},
+	}
+
+	for _, test := range table {
+		if res := serverFilename(test.disposition, test.url); res != test.expected {
+			t.Errorf("serverFilename(%q, %q)=%q, expected %q", test.disposition, test.url, res, test.expected)
+		}
+	}
+}
+
+// clonkGroup returns a fake Clonk group that contains the given entry names
+func clonkGroup(names string) []byte {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write([]byte("scrambled header" + names))
+	zw.Close()
+
+	group := buf.Bytes()
+	group[0], group[1] = 0x1e, 0x8c
+	return group
+}
+
+func TestSniffExtension(t *testing.T) {
+	table := map[string][]byte{
+		"zip": []byte("PK\x03\x04rest of the file"),
+		"rar": []byte("Rar!\x1a\x07\x00"),
+		"exe": []byte("MZ\x90\x00"),
+		"bz2": []byte("BZh91AY&SY"),
+		"c4s": clonkGroup("Scenario.txt Title.txt Knight.c4d DefCore.txt"),
+		"c4d": clonkGroup("DefCore.txt Graphics.png"),
+		"c4f": clonkGroup("Folder.txt Melee.c4s Scenario.txt"),
+		"c4g": clonkGroup("Graphics.png"),
+		"":    []byte("<html>Not found</html>"),
+	}
+
+	for expected, content := range table {
+		if res := sniffExtension(bytes.NewReader(content)); res != expected {
+			t.Errorf("sniffExtension(%q)=%q, expected %q", content, res, expected)
+		}
+	}
+
+	// The name the server sent is preferred over the url and the content
+	if res := fileExtension("Hazard.c4d", "https://example.com/file.zip", bytes.NewReader(table["c4s"])); res != "c4d" {
+		t.Errorf("expected the extension of the server name, got %q", res)
+	}
+	if res := fileExtension("", "https://example.com/dl.pl?id=1", bytes.NewReader(table["c4s"])); res != "c4s" {
+		t.Errorf("expected the sniffed extension, got %q", res)
+	}
+}
+
+func TestQuarantineReason(t *testing.T) {
+	table := []struct {
+		contentType, ext, content string
+		quarantined               bool
+	}{
+		{"application/octet-stream", "c4s", "\x1e\x8c\x08binary", false},
+		{"text/html", "c4s", "\x1e\x8c\x08binary", false},
+		{"application/octet-stream", "c4d", "<!DOCTYPE html><title>404 Not Found</title>", true},
+		{"text/html; charset=utf-8", "c4d", "File not found", true},
+		{"text/plain", "c4d", "File not found", true},
+		{"", "c4d", "printable, but binary", false},
+		{"text/plain", "txt", "Just a text file", false},
+		{"application/octet-stream", "zip", "", true},
+	}
+
+	for _, test := range table {
+		reason, _ := quarantineReason(test.contentType, test.ext, bytes.NewReader([]byte(test.content)))
+		if (reason != "") != test.quarantined {
+			t.Errorf("quarantineReason(%q, %q, %q)=%q, expected quarantined=%v", test.contentType, test.ext, test.content, reason, test.quarantined)
+		}
+	}
+}
+
+func TestCleanFilename(t *testing.T) {
+	table := map[string]string{
+		"Café Łódź":              "Cafe Lodz",
+		"Мельница":               "Melnitsa",
+		"Mühle – Western":        "Mühle - Western",
+		"CON":                    "CON_",
+		"nul.c4d":                "nul_.c4d",
+		"Mod v1. ":               "Mod v1",
+		"..":                     nameHash(".."),
+		"★★★":                    nameHash("★★★"),
+		"":                       nameHash(""),
+		strings.Repeat("a", 150): strings.Repeat("a", maxComponentLength),
+	}
+
+	for in, expected := range table {
+		if res := cleanFilename(in); res != expected {
+			t.Errorf("cleanFilename(%q)=%q, expected %q", in, res, expected)
+		}
+	}
+
+}
+
+func TestItemPath(t *testing.T) {
+	var (
+		a = strings.Repeat("a", 150)
+		b = strings.Repeat("b", 150)
+	)
+	table := []struct {
+		components []string
+		prefix     string
+	}{
+		{[]string{"CCAN", "Author", "Mod"}, "CCAN/Author/Mod"},
+		{[]string{"CCAN", strings.Repeat("b", 90), strings.Repeat("ö", 90)}, "CCAN/" + strings.Repeat("b", 90) + "/ö"},
+		{[]string{a, b, "name"}, strings.Repeat("a", 48) + "/" + strings.Repeat("b", 48) + "/name"},
+		{[]string{a, b, a, b, a}, strings.Repeat("a", 23) + "/" + strings.Repeat("b", 23) + "/"},
+		{[]string{strings.Repeat("ö", 100), strings.Repeat("★", 100), b}, "öö"},
+		{append(make([]string, 150), "name"), ""},
+	}
+
+	for _, test := range table {
+		res := itemPath("c4d", test.components...)
+		if len(res)+len(".c4d") > maxPathLength && len(test.components) < 100 || !utf8.ValidString(res) || !strings.HasPrefix(res, test.prefix) {
+			t.Errorf("itemPath(%q) returned %q with %d bytes", test.components, res, len(res))
+		}
+		for _, c := range strings.Split(res, "/") {
+			if c == "" {
+				t.Errorf("itemPath(%q) returned %q with an empty component", test.components, res)
+			}
+		}
+	}
+}
+
+func TestInterrupted(t *testing.T) {
+	dir, err := ioutil.TempDir("", "zipfactory-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The run is cancelled once the fourth item is requested. It only has one downloader, so the first three are done
+	const (
+		count       = 6
+		interrupted = 3
+	)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	fetcher := &testFetcher{delay: func(url string) time.Duration {
+		if url == fmt.Sprintf("https://example.com/%d.c4d", interrupted) {
+			cancel()
+			return time.Hour
+		}
+		return 0
+	}}
+
+	path := filepath.Join(dir, "archive.zip")
+	err = CreateZipFileFromItems(ctx, testItems(count), Options{Path: path, Fetcher: fetcher, Downloaders: 1})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected the run to return context.Canceled, got %v", err)
+	}
+
+	r, err := zip.OpenReader(path)
+	if err != nil {
+		t.Fatalf("interrupted archive cannot be opened: %s", err.Error())
+	}
+	defer r.Close()
+
+	var files = make(map[string]string)
+	for _, f := range r.File {
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatalf("reading %s: %s", f.Name, err.Error())
+		}
+		files[f.Name] = string(content)
+	}
+
+	for i := 0; i < count; i++ {
+		link := fmt.Sprintf("https://example.com/%d.c4d", i)
+		name := fmt.Sprintf("Test/author/httpsexample.com%d.c4d.c4d", i)
+		if content, ok := files[name]; i < interrupted && content != link {
+			t.Errorf("expected %s to contain %q, got %q", name, link, content)
+		} else if i >= interrupted && ok {
+			t.Errorf("%s was archived although the run was interrupted before", name)
+		}
+	}
+	if !strings.Contains(files["README.md"], "The download was interrupted before all items were archived") {
+		t.Errorf("README doesn't mention the interruption:\n%s", files["README.md"])
+	}
+}
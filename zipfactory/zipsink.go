@@ -0,0 +1,203 @@
+package zipfactory
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+)
+
+// zipSink writes a zip file. All entries are written with known sizes and checksums, so they don't need a data descriptor
+// and end exactly where the next one begins. This makes it possible to continue the file after an interruption
+type zipSink struct {
+	f   *os.File
+	out *countingWriter
+	w   *zip.Writer
+
+	// written are the entries since the last checkpoint
+	written []journalEntry
+}
+
+func newZipSink(f *os.File) *zipSink {
+	out := &countingWriter{w: &skipWriter{w: f}}
+	return &zipSink{
+		f:   f,
+		out: out,
+		w:   zip.NewWriter(out),
+	}
+}
+
+// CreateEntry implements Sink. Most files are compressed already, so they are stored as they are
+func (z *zipSink) CreateEntry(name string, content io.Reader, size int64, crc uint32) error {
+	return z.writeEntry(journalEntry{
+		Name:             name,
+		Method:           zip.Store,
+		CRC32:            crc,
+		CompressedSize:   uint64(size),
+		UncompressedSize: uint64(size),
+	}, content)
+}
+
+// WriteMetadata implements Sink
+func (z *zipSink) WriteMetadata(name string, content []byte) error {
+	e, compressed, err := deflateEntry(name, content)
+	if err != nil {
+		return err
+	}
+	return z.writeEntry(e, bytes.NewReader(compressed))
+}
+
+// Finalize implements Sink. The central directory is written here; without it the archive is unreadable
+func (z *zipSink) Finalize() error {
+	err := z.w.Close()
+	if cerr := z.f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// writeEntry writes an entry whose compressed content, size and checksum are known. The zip writer is flushed,
+// so the entry has been written when it returns
+func (z *zipSink) writeEntry(e journalEntry, compressed io.Reader) error {
+	if err := z.w.Flush(); err != nil {
+		return fmt.Errorf("while flushing archive: %w", err)
+	}
+	e.Offset = z.out.n
+
+	raw, err := z.w.CreateRaw(e.header())
+	if err != nil {
+		return fmt.Errorf("while creating file %s: %w", e.Name, err)
+	}
+	if _, err = io.CopyN(raw, compressed, int64(e.CompressedSize)); err != nil {
+		return fmt.Errorf("while copying %s to archive: %w", e.Name, err)
+	}
+	if err = z.w.Flush(); err != nil {
+		return fmt.Errorf("while flushing %s: %w", e.Name, err)
+	}
+	z.written = append(z.written, e)
+	return nil
+}
+
+func (z *zipSink) checkpoint(sync bool) (entries []journalEntry, end int64, err error) {
+	if sync {
+		if err = z.f.Sync(); err != nil {
+			return
+		}
+	}
+	entries, z.written = z.written, nil
+	return entries, z.out.n, nil
+}
+
+// recover adds the entries of all items to the zip writer, so they end up in the central directory.
+// Their content is already in the file and is not written again. Everything after the last item, e.g. a partially written
+// entry or the central directory of an interrupted run, is removed
+func (z *zipSink) recover(items []journalItem) error {
+	if len(items) == 0 {
+		return z.f.Truncate(0)
+	}
+
+	end := items[len(items)-1].End
+	info, err := z.f.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() < end {
+		return fmt.Errorf("the archive is shorter than recorded in its journal")
+	}
+	if err = z.f.Truncate(end); err != nil {
+		return err
+	}
+	if _, err = z.f.Seek(end, io.SeekStart); err != nil {
+		return err
+	}
+
+	z.out.w.(*skipWriter).skip = end
+	for _, item := range items {
+		for _, e := range item.Entries {
+			if err = checkLocalHeader(z.f, e); err != nil {
+				return err
+			}
+			if err = z.writeEntry(e, zeroReader{}); err != nil {
+				return err
+			}
+			if written := z.written[len(z.written)-1]; written.Offset != e.Offset {
+				return fmt.Errorf("entry %s was recorded at offset %d, but would be at %d", e.Name, e.Offset, written.Offset)
+			}
+		}
+		if z.out.n != item.End {
+			return fmt.Errorf("item %s was recorded to end at offset %d, but would end at %d", item.Link, item.End, z.out.n)
+		}
+	}
+	z.written = nil
+
+	return nil
+}
+
+// deflateEntry compresses content and returns the entry it can be written with
+func deflateEntry(name string, content []byte) (e journalEntry, compressed []byte, err error) {
+	var buf bytes.Buffer
+	fw, err := flate.NewWriter(&buf, flate.DefaultCompression)
+	if err != nil {
+		return
+	}
+	if _, err = fw.Write(content); err != nil {
+		return
+	}
+	if err = fw.Close(); err != nil {
+		return
+	}
+
+	return journalEntry{
+		Name:             name,
+		Method:           zip.Deflate,
+		CRC32:            crc32.ChecksumIEEE(content),
+		CompressedSize:   uint64(buf.Len()),
+		UncompressedSize: uint64(len(content)),
+	}, buf.Bytes(), nil
+}
+
+// countingWriter counts the bytes written to it
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (n int, err error) {
+	n, err = c.w.Write(p)
+	c.n += int64(n)
+	return
+}
+
+// skipWriter discards the first skip bytes written to it. When resuming, they are already in the file
+type skipWriter struct {
+	w    io.Writer
+	skip int64
+}
+
+func (s *skipWriter) Write(p []byte) (int, error) {
+	var skipped int
+	if s.skip > 0 {
+		if int64(len(p)) <= s.skip {
+			s.skip -= int64(len(p))
+			return len(p), nil
+		}
+		skipped = int(s.skip)
+		s.skip = 0
+	}
+
+	n, err := s.w.Write(p[skipped:])
+	return skipped + n, err
+}
+
+// zeroReader returns an endless stream of zeros. It stands in for content that is skipped by skipWriter
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}